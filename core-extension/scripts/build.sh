@@ -4,5 +4,8 @@ set -exuo pipefail
 cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 source .envrc
 
+GOOS=linux go build -ldflags="-s -w" -o bin/detect newrelic-dotnetcore-extension/detect/cli
 GOOS=linux go build -ldflags="-s -w" -o bin/supply newrelic-dotnetcore-extension/supply/cli
 GOOS=linux go build -ldflags="-s -w" -o bin/finalize newrelic-dotnetcore-extension/finalize/cli
+GOOS=linux go build -ldflags="-s -w" -o bin/newrelic-launch newrelic-dotnetcore-extension/launch/cli
+GOOS=linux go build -ldflags="-s -w" -o bin/newrelic-simulate newrelic-dotnetcore-extension/simulate/cli
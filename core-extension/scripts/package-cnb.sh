@@ -0,0 +1,20 @@
+#!/usr/bin/env bash
+# packages the cloud native buildpack in build/cnb, and in build/newrelic-dotnetcore-extension-cnb-<version>.tgz
+set -exuo pipefail
+
+cd "$( dirname "${BASH_SOURCE[0]}" )/.."
+source .envrc
+
+version=$(cat VERSION)
+target=build/cnb
+rm -rf "$target"
+mkdir -p "$target/bin"
+
+GOOS=linux go build -ldflags="-s -w" -o "$target/bin/build" newrelic-dotnetcore-extension/cnb/cli
+ln -s build "$target/bin/detect"
+GOOS=linux go build -ldflags="-s -w" -o "$target/bin/newrelic-launch" newrelic-dotnetcore-extension/launch/cli
+
+sed "s/^  version = .*/  version = \"$version\"/" cnb/buildpack.toml > "$target/buildpack.toml"
+cp manifest.yml newrelic.config credentials.yml README.md VERSION "$target/"
+
+tar -czf "build/newrelic-dotnetcore-extension-cnb-$version.tgz" -C "$target" .
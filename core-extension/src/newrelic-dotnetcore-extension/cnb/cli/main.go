@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"newrelic-dotnetcore-extension/cnb"
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/packit"
+)
+
+// bin/detect <platform> <plan> and bin/build <layers> <platform> <plan> of the cloud native buildpack,
+// both are this program
+func main() {
+	phase := filepath.Base(os.Args[0])
+
+	platformDir := ""
+	switch {
+	case phase == "detect" && len(os.Args) > 1:
+		platformDir = os.Args[1]
+	case phase == "build" && len(os.Args) > 2:
+		platformDir = os.Args[2]
+	default:
+		os.Stderr.WriteString("usage: detect <platform> <plan> | build <layers> <platform> <plan>\n")
+		os.Exit(2)
+	}
+
+	env := cnb.PlatformEnvironment{PlatformDir: platformDir}
+	redactor := nrbuildpack.NewRedactor(os.Stdout)
+	redactor.AddSecretsFromEnv(env.Environ())
+	builder := &cnb.Builder{Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Env: env}
+
+	if phase == "detect" {
+		packit.Detect(builder.Detect, packit.WithExitHandler(exitHandler{}))
+	} else {
+		packit.Build(builder.Build, packit.WithExitHandler(exitHandler{}))
+	}
+}
+
+// exitHandler exits with 100 when the buildpack does not apply, the lifecycle then skips it
+type exitHandler struct{}
+
+func (h exitHandler) Error(err error) {
+	if err == cnb.ErrNotApplicable {
+		os.Exit(100)
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
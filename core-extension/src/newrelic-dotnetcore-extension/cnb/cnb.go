@@ -0,0 +1,362 @@
+package cnb
+
+import (
+	"errors"
+	"io/ioutil"
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"newrelic-dotnetcore-extension/supply"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/packit"
+)
+
+// name of the build plan entry, provided and required by the buildpack itself
+const planEntryName = "newrelic-dotnet-agent"
+
+// launch layer with the agent, cached between builds and reused while the agent doesn't change
+const agentLayerName = "newrelic-agent"
+
+// launch layer with the profiler env vars and the exec.d program resolving the credentials
+const envLayerName = "newrelic-env"
+
+// ErrNotApplicable fails detect, the lifecycle then skips the buildpack
+var ErrNotApplicable = errors.New("New Relic extension does not apply")
+
+// Builder implements detect and build of the cloud native buildpack
+type Builder struct {
+	Log        *libbuildpack.Logger
+	Redactor   *nrbuildpack.Redactor
+	Env        nrbuildpack.Environment
+	HTTPClient nrbuildpack.HTTPClient // defaults to the client of nrbuildpack.Supplier
+}
+
+// the buildpack applies to .Net apps bound to New Relic, like bin/detect of the extension
+func (b *Builder) Detect(context packit.DetectContext) (packit.DetectResult, error) {
+	s := &nrbuildpack.Supplier{Log: b.Log, Redactor: b.Redactor, Env: b.Env}
+	applies, reason := nrbuildpack.Detect(s, context.WorkingDir)
+	if !applies {
+		b.Log.Info("New Relic extension does not apply: %s", reason)
+		return packit.DetectResult{}, ErrNotApplicable
+	}
+	b.Log.Info("New Relic extension applies: %s", reason)
+
+	return packit.DetectResult{
+		Plan: packit.BuildPlan{
+			Provides: []packit.BuildPlanProvision{{Name: planEntryName}},
+			Requires: []packit.BuildPlanRequirement{{Name: planEntryName, Metadata: map[string]interface{}{"launch": true}}},
+		},
+	}, nil
+}
+
+// Build installs the agent in the agent layer with the same logic as the supply of the extension
+func (b *Builder) Build(context packit.BuildContext) (packit.BuildResult, error) {
+	agentLayer, err := context.Layers.Get(agentLayerName, packit.LaunchLayer, packit.CacheLayer)
+	if err != nil {
+		return packit.BuildResult{}, err
+	}
+	envLayer, err := context.Layers.Get(envLayerName, packit.LaunchLayer)
+	if err != nil {
+		return packit.BuildResult{}, err
+	}
+	// the agent folders are kept for CachedAgent, which removes them when the agent changes
+	if err := resetLayer(agentLayer, agentFolder(true), agentFolder(false)); err != nil {
+		return packit.BuildResult{}, err
+	}
+	if err := resetLayer(envLayer); err != nil {
+		return packit.BuildResult{}, err
+	}
+
+	cacheDir, err := ioutil.TempDir("", "newrelic-cache")
+	if err != nil {
+		return packit.BuildResult{}, err
+	}
+	defer os.RemoveAll(cacheDir)
+
+	platform := &Platform{
+		AgentLayer: &agentLayer,
+		EnvLayer:   &envLayer,
+		previous:   readLayerMetadata(filepath.Join(context.Layers.Path, agentLayerName+".toml")),
+	}
+	s := &nrbuildpack.Supplier{
+		Stager:       &layerStager{buildDir: context.WorkingDir, layersDir: context.Layers.Path, cacheDir: cacheDir},
+		Log:          b.Log,
+		Redactor:     b.Redactor,
+		Platform:     platform,
+		Env:          buildpackEnvironment{Environment: b.Env, buildpackDir: context.CNBPath},
+		HTTPClient:   b.HTTPClient,
+		LaunchHelper: filepath.Join(context.CNBPath, "bin", "newrelic-launch"),
+	}
+	if exists, _ := libbuildpack.FileExists(filepath.Join(context.CNBPath, "manifest.yml")); exists {
+		manifest, err := libbuildpack.NewManifest(context.CNBPath, b.Log, time.Now())
+		if err != nil {
+			return packit.BuildResult{}, err
+		}
+		s.Manifest = manifest
+	}
+
+	if err := s.Run(); err != nil {
+		return packit.BuildResult{}, err
+	}
+	source := s.AgentSource()
+	if source == nil || !platform.written {
+		// not bound to New Relic, or the agent is disabled and not installed
+		return packit.BuildResult{Plan: context.Plan}, nil
+	}
+
+	agentLayer.Metadata = layerMetadata(*source)
+	for i := range context.Plan.Entries {
+		if context.Plan.Entries[i].Name == planEntryName {
+			context.Plan.Entries[i].Version = source.Version
+		}
+	}
+	for _, layer := range []packit.Layer{agentLayer, envLayer} {
+		if err := writeLayer(context.Layers.Path, layer); err != nil {
+			return packit.BuildResult{}, err
+		}
+	}
+	return packit.BuildResult{Plan: context.Plan}, nil
+}
+
+// layerToml is <layers>/<layer>.toml of buildpack API 0.6 and later. The vendored packit writes
+// the flags of API 0.5 at the top level, so the layers are written here instead of in BuildResult.
+type layerToml struct {
+	Types    layerTypes             `toml:"types"`
+	Metadata map[string]interface{} `toml:"metadata"`
+}
+
+type layerTypes struct {
+	Build  bool `toml:"build"`
+	Launch bool `toml:"launch"`
+	Cache  bool `toml:"cache"`
+}
+
+// writeLayer writes the toml and the launch env vars of the layer
+func writeLayer(layersDir string, layer packit.Layer) error {
+	content := layerToml{
+		Types:    layerTypes{Build: layer.Build, Launch: layer.Launch, Cache: layer.Cache},
+		Metadata: layer.Metadata,
+	}
+	file, err := os.Create(filepath.Join(layersDir, layer.Name+".toml"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := toml.NewEncoder(file).Encode(content); err != nil {
+		return err
+	}
+
+	envDir := filepath.Join(layer.Path, "env.launch")
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return err
+	}
+	for name, value := range layer.LaunchEnv {
+		if err := ioutil.WriteFile(filepath.Join(envDir, name), []byte(value), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetLayer removes the files of the previous build from the layer, except the ones to keep
+func resetLayer(layer packit.Layer, keep ...string) error {
+	files, err := ioutil.ReadDir(layer.Path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		kept := false
+		for _, name := range keep {
+			if file.Name() == name {
+				kept = true
+			}
+		}
+		if kept {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(layer.Path, file.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadata of the agent layer, the layer is reused when it matches the agent to install
+func layerMetadata(source nrbuildpack.AgentSource) map[string]interface{} {
+	return map[string]interface{}{
+		"agent_version": source.Version,
+		"agent_url":     source.URL,
+		"agent_sha256":  source.SHA256,
+		"method":        source.Method,
+		"new_layout":    source.NewLayout,
+	}
+}
+
+func readLayerMetadata(layerToml string) map[string]interface{} {
+	var layer struct {
+		Metadata map[string]interface{} `toml:"metadata"`
+	}
+	if _, err := toml.DecodeFile(layerToml, &layer); err != nil {
+		return nil
+	}
+	return layer.Metadata
+}
+
+// buildpackEnvironment points BUILDPACK_DIR at the cloud native buildpack, which has the
+// same newrelic.config, credentials.yml and manifest.yml as the extension buildpack
+type buildpackEnvironment struct {
+	nrbuildpack.Environment
+	buildpackDir string
+}
+
+func (e buildpackEnvironment) LookupEnv(name string) (string, bool) {
+	if name == "BUILDPACK_DIR" {
+		return e.buildpackDir, true
+	}
+	return e.Environment.LookupEnv(name)
+}
+
+// layerStager maps the staging folders of the extension to the build: the app is the working dir,
+// and the agent is installed in the agent layer
+type layerStager struct {
+	buildDir  string
+	layersDir string
+	cacheDir  string
+}
+
+func (s *layerStager) BuildDir() string { return s.buildDir }
+func (s *layerStager) DepDir() string   { return filepath.Join(s.layersDir, agentLayerName) }
+func (s *layerStager) DepsIdx() string  { return agentLayerName }
+func (s *layerStager) DepsDir() string  { return s.layersDir }
+func (s *layerStager) CacheDir() string { return s.cacheDir }
+
+func (s *layerStager) WriteProfileD(scriptName string, scriptContents string) error {
+	return errors.New("profile.d scripts are not supported by cloud native buildpacks")
+}
+
+// Platform installs the linux agent like the extension, but sets the profiler env vars
+// in the env layer instead of profile.d, and reuses the agent layer of the previous build
+type Platform struct {
+	supply.Platform
+	AgentLayer *packit.Layer
+	EnvLayer   *packit.Layer
+
+	previous map[string]interface{} // agent layer metadata of the previous build
+	written  bool
+}
+
+// layer paths are the same during the build and when the app runs
+func (p *Platform) AgentPath(s *nrbuildpack.Supplier, agentDir string) (string, string) {
+	return "", agentDir
+}
+
+func (p *Platform) CachedAgent(s *nrbuildpack.Supplier, source nrbuildpack.AgentSource) (string, bool) {
+	agentDir := filepath.Join(p.AgentLayer.Path, agentFolder(source.NewLayout))
+	if p.previous != nil && source.Version != "" {
+		current := layerMetadata(source)
+		same := true
+		for _, key := range []string{"agent_version", "agent_url", "agent_sha256", "new_layout"} {
+			if current[key] != p.previous[key] {
+				same = false
+			}
+		}
+		if exists, _ := libbuildpack.FileExists(agentDir); same && exists {
+			return agentDir, true
+		}
+	}
+
+	// another agent, remove the previous one (the layer also holds the download of the new one)
+	os.RemoveAll(filepath.Join(p.AgentLayer.Path, agentFolder(true)))
+	os.RemoveAll(filepath.Join(p.AgentLayer.Path, agentFolder(false)))
+	return "", false
+}
+
+// SBOMFile returns <layers>/newrelic-agent.sbom.<format>, where the lifecycle looks for the SBOM of the agent layer
+func (p *Platform) SBOMFile(s *nrbuildpack.Supplier, format string) string {
+	layersDir := filepath.Dir(p.AgentLayer.Path)
+	if exists, _ := libbuildpack.FileExists(layersDir); !exists {
+		return ""
+	}
+	return filepath.Join(layersDir, agentLayerName+".sbom."+format)
+}
+
+// WriteScript sets the profiler env vars of the script in the env layer, and writes the exec.d
+// program which resolves the credentials when the app starts like the launch helper of profile.d
+func (p *Platform) WriteScript(s *nrbuildpack.Supplier, script *nrbuildpack.Script) (string, error) {
+	var agentDir string
+	for _, scriptVar := range script.Vars() {
+		p.EnvLayer.LaunchEnv.Override(scriptVar.Name, scriptVar.Value)
+		if scriptVar.Name == "CORECLR_NEWRELIC_HOME" {
+			agentDir = scriptVar.Value
+		}
+	}
+
+	execD := filepath.Join(p.EnvLayer.Path, "exec.d", "newrelic")
+	if err := os.MkdirAll(filepath.Dir(execD), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(execD, []byte(execDProgram(agentDir)), 0755); err != nil {
+		return "", err
+	}
+	p.written = true
+	return execD, nil
+}
+
+// the exec.d program writes the env vars as TOML to file descriptor 3.
+// NEW_RELIC_AGENT_ENABLED=false disables the profiler like the profile.d script of the extension.
+func execDProgram(agentDir string) string {
+	return "#!/bin/sh\n" +
+		"if [ \"$(printf '%s' \"${NEW_RELIC_AGENT_ENABLED:-}\" | tr '[:upper:]' '[:lower:]')\" = 'false' ]; then\n" +
+		"  printf 'CORECLR_ENABLE_PROFILING = \"0\"\\n' >&3\n" +
+		"  exit 0\n" +
+		"fi\n" +
+		"exec " + nrbuildpack.QuotePosix(filepath.Join(agentDir, "newrelic-launch")) + " -format toml" +
+		" -mappings " + nrbuildpack.QuotePosix(filepath.Join(agentDir, "credentials.yml")) +
+		" -config " + nrbuildpack.QuotePosix(filepath.Join(agentDir, "newrelic.config")) + " >&3\n"
+}
+
+// WritableAgentHome makes the agent home the exec.d program points the agent at when the app starts.
+// Layers are read-only when the app runs, so the home in tempDir links to the files of the agent layer,
+// with a copy of newrelic.config for the settings resolved at launch, and a logs folder of its own.
+func WritableAgentHome(agentDir string, tempDir string) (string, error) {
+	home := filepath.Join(tempDir, "newrelic-agent-home")
+	if err := os.RemoveAll(home); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(home, "logs"), 0755); err != nil {
+		return "", err
+	}
+	files, err := ioutil.ReadDir(agentDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		source, target := filepath.Join(agentDir, file.Name()), filepath.Join(home, file.Name())
+		switch file.Name() {
+		case "logs":
+		case "newrelic.config":
+			if err := libbuildpack.CopyFile(source, target); err != nil {
+				return "", err
+			}
+			if err := os.Chmod(target, 0644); err != nil {
+				return "", err
+			}
+		default:
+			if err := os.Symlink(source, target); err != nil {
+				return "", err
+			}
+		}
+	}
+	return home, nil
+}
+
+// the archive contains the agent folder, "newrelic-dotnet-agent" since agent 10.0, "newrelic-netcore20-agent" before
+func agentFolder(newLayout bool) string {
+	if newLayout {
+		return "newrelic-dotnet-agent"
+	}
+	return "newrelic-netcore20-agent"
+}
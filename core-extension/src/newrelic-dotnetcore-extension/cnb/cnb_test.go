@@ -0,0 +1,312 @@
+package cnb_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"newrelic-dotnetcore-extension/cnb"
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/packit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeEnvironment is an nrbuildpack.Environment backed by a map
+type fakeEnvironment map[string]string
+
+func (e fakeEnvironment) LookupEnv(name string) (string, bool) {
+	value, ok := e[name]
+	return value, ok
+}
+
+func (e fakeEnvironment) Environ() []string {
+	var environ []string
+	for name, value := range e {
+		environ = append(environ, name+"="+value)
+	}
+	return environ
+}
+
+// fakeHTTPClient returns the archive for any url and counts the requests
+type fakeHTTPClient struct {
+	archive  []byte
+	requests []string
+}
+
+func (c *fakeHTTPClient) Get(url string) (*http.Response, error) {
+	c.requests = append(c.requests, url)
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Body: ioutil.NopCloser(bytes.NewReader(c.archive))}, nil
+}
+
+// agentArchive returns a tar.gz agent with the files in agentFolder
+func agentArchive(agentFolder string, files map[string]string) []byte {
+	buffer := new(bytes.Buffer)
+	gz := gzip.NewWriter(buffer)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		header := &tar.Header{Name: agentFolder + "/" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		Expect(tw.WriteHeader(header)).To(Succeed())
+		_, err := tw.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gz.Close()).To(Succeed())
+	return buffer.Bytes()
+}
+
+const agentURL = "http://download.example.com/newrelic-dotnet-agent_10.1.0_amd64.tar.gz"
+
+var _ = Describe("Cnb", func() {
+	var (
+		root       string
+		workingDir string
+		cnbPath    string
+		layersDir  string
+		env        fakeEnvironment
+		httpClient *fakeHTTPClient
+		buffer     *bytes.Buffer
+		builder    *cnb.Builder
+	)
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0755)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "cnb")
+		Expect(err).NotTo(HaveOccurred())
+		workingDir = filepath.Join(root, "workspace")
+		cnbPath = filepath.Join(root, "buildpack")
+		layersDir = filepath.Join(root, "layers")
+		writeFile(filepath.Join(workingDir, "app.runtimeconfig.json"), "{}")
+		writeFile(filepath.Join(cnbPath, "bin", "newrelic-launch"), "launch helper")
+		Expect(os.MkdirAll(layersDir, 0755)).To(Succeed())
+
+		env = fakeEnvironment{"NEW_RELIC_LICENSE_KEY": "license", "NEW_RELIC_DOWNLOAD_URL": agentURL}
+		httpClient = &fakeHTTPClient{archive: agentArchive("newrelic-dotnet-agent", map[string]string{
+			"libNewRelicProfiler.so": "profiler",
+			"newrelic.config":        "<configuration/>",
+		})}
+		buffer = new(bytes.Buffer)
+		redactor := nrbuildpack.NewRedactor(buffer)
+		builder = &cnb.Builder{Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Env: env, HTTPClient: httpClient}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	build := func() packit.BuildResult {
+		result, err := builder.Build(packit.BuildContext{
+			CNBPath:    cnbPath,
+			WorkingDir: workingDir,
+			Plan:       packit.BuildpackPlan{Entries: []packit.BuildpackPlanEntry{{Name: "newrelic-dotnet-agent"}}},
+			Layers:     packit.Layers{Path: layersDir},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return result
+	}
+
+	// layerToml reads <layers>/<layer>.toml in the format of buildpack API 0.6 and later
+	type layerToml struct {
+		Types struct {
+			Launch bool `toml:"launch"`
+			Cache  bool `toml:"cache"`
+		} `toml:"types"`
+		Metadata map[string]interface{} `toml:"metadata"`
+	}
+	readLayer := func(name string) layerToml {
+		var layer layerToml
+		_, err := toml.DecodeFile(filepath.Join(layersDir, name+".toml"), &layer)
+		Expect(err).NotTo(HaveOccurred())
+		return layer
+	}
+	readLaunchEnv := func(name string) map[string]string {
+		env := map[string]string{}
+		envDir := filepath.Join(layersDir, name, "env.launch")
+		files, err := ioutil.ReadDir(envDir)
+		Expect(err).NotTo(HaveOccurred())
+		for _, file := range files {
+			content, err := ioutil.ReadFile(filepath.Join(envDir, file.Name()))
+			Expect(err).NotTo(HaveOccurred())
+			env[file.Name()] = string(content)
+		}
+		return env
+	}
+
+	Describe("Detect", func() {
+		It("requires the agent for .Net apps bound to New Relic", func() {
+			result, err := builder.Detect(packit.DetectContext{WorkingDir: workingDir})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Plan.Provides).To(Equal([]packit.BuildPlanProvision{{Name: "newrelic-dotnet-agent"}}))
+			Expect(result.Plan.Requires).To(HaveLen(1))
+			Expect(result.Plan.Requires[0].Metadata).To(HaveKeyWithValue("launch", true))
+		})
+
+		It("does not apply without a New Relic binding", func() {
+			delete(env, "NEW_RELIC_LICENSE_KEY")
+			delete(env, "NEW_RELIC_DOWNLOAD_URL")
+
+			_, err := builder.Detect(packit.DetectContext{WorkingDir: workingDir})
+			Expect(err).To(Equal(cnb.ErrNotApplicable))
+			Expect(buffer.String()).To(ContainSubstring("no New Relic binding"))
+		})
+	})
+
+	Describe("Build", func() {
+		It("installs the agent in a launch layer and sets the profiler env vars", func() {
+			result := build()
+
+			agentLayer, envLayer := readLayer("newrelic-agent"), readLayer("newrelic-env")
+			agentDir := filepath.Join(layersDir, "newrelic-agent", "newrelic-dotnet-agent")
+
+			Expect(agentLayer.Types.Launch).To(BeTrue())
+			Expect(agentLayer.Types.Cache).To(BeTrue())
+			Expect(agentLayer.Metadata).To(HaveKeyWithValue("agent_version", "10.1.0"))
+			Expect(agentLayer.Metadata).To(HaveKeyWithValue("agent_url", agentURL))
+			Expect(filepath.Join(agentDir, "libNewRelicProfiler.so")).To(BeAnExistingFile())
+			Expect(filepath.Join(agentDir, "newrelic-launch")).To(BeAnExistingFile())
+			Expect(result.Plan.Entries[0].Version).To(Equal("10.1.0"))
+
+			Expect(envLayer.Types.Launch).To(BeTrue())
+			Expect(envLayer.Types.Cache).To(BeFalse())
+			launchEnv := readLaunchEnv("newrelic-env")
+			Expect(launchEnv).To(HaveKeyWithValue("CORECLR_ENABLE_PROFILING.override", "1"))
+			Expect(launchEnv).To(HaveKeyWithValue("CORECLR_NEWRELIC_HOME.override", agentDir))
+			Expect(launchEnv).To(HaveKeyWithValue("CORECLR_PROFILER_PATH.override", filepath.Join(agentDir, "libNewRelicProfiler.so")))
+
+			execD, err := ioutil.ReadFile(filepath.Join(layersDir, "newrelic-env", "exec.d", "newrelic"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(execD)).To(ContainSubstring("exec '" + filepath.Join(agentDir, "newrelic-launch") + "' -format toml"))
+			Expect(string(execD)).To(ContainSubstring("NEW_RELIC_AGENT_ENABLED"))
+		})
+
+		It("writes the SBOM of the agent layer where the lifecycle collects it", func() {
+			build()
+
+			Expect(filepath.Join(layersDir, "newrelic-agent.sbom.cdx.json")).To(BeARegularFile())
+			Expect(filepath.Join(layersDir, "newrelic-agent.sbom.spdx.json")).To(BeARegularFile())
+			cdx, err := ioutil.ReadFile(filepath.Join(layersDir, "newrelic-agent.sbom.cdx.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(cdx)).To(ContainSubstring(`"bomFormat": "CycloneDX"`))
+		})
+
+		It("reuses the agent layer of the previous build for the same agent", func() {
+			build()
+			Expect(httpClient.requests).To(HaveLen(1))
+
+			build()
+			Expect(httpClient.requests).To(HaveLen(1))
+			Expect(buffer.String()).To(ContainSubstring("Reusing New Relic agent 10.1.0"))
+			Expect(filepath.Join(layersDir, "newrelic-agent", "newrelic-dotnet-agent", "libNewRelicProfiler.so")).To(BeAnExistingFile())
+			Expect(readLayer("newrelic-agent").Metadata).To(HaveKeyWithValue("agent_version", "10.1.0"))
+		})
+
+		It("replaces the agent layer when the agent changes", func() {
+			build()
+			env["NEW_RELIC_DOWNLOAD_URL"] = strings.Replace(agentURL, "10.1.0", "10.2.0", -1)
+
+			build()
+			Expect(httpClient.requests).To(HaveLen(2))
+			Expect(readLayer("newrelic-agent").Metadata).To(HaveKeyWithValue("agent_version", "10.2.0"))
+		})
+
+		It("removes the files of the previous build from the layers", func() {
+			build()
+			writeFile(filepath.Join(layersDir, "newrelic-agent", "stale.txt"), "stale")
+			writeFile(filepath.Join(layersDir, "newrelic-env", "env.launch", "STALE.override"), "stale")
+
+			build()
+			Expect(filepath.Join(layersDir, "newrelic-agent", "stale.txt")).NotTo(BeAnExistingFile())
+			Expect(readLaunchEnv("newrelic-env")).NotTo(HaveKey("STALE.override"))
+			Expect(filepath.Join(layersDir, "newrelic-agent", "newrelic-dotnet-agent", "libNewRelicProfiler.so")).To(BeAnExistingFile())
+			Expect(httpClient.requests).To(HaveLen(1))
+		})
+
+		It("quotes the paths of the exec.d program", func() {
+			layersDir = filepath.Join(root, "it's layers")
+			Expect(os.MkdirAll(layersDir, 0755)).To(Succeed())
+
+			build()
+			execD, err := ioutil.ReadFile(filepath.Join(layersDir, "newrelic-env", "exec.d", "newrelic"))
+			Expect(err).NotTo(HaveOccurred())
+			agentDir := strings.Replace(filepath.Join(layersDir, "newrelic-agent", "newrelic-dotnet-agent"), "'", `'\''`, -1)
+			Expect(string(execD)).To(ContainSubstring("exec '" + agentDir + "/newrelic-launch' -format toml"))
+		})
+
+		It("contributes no layer without a New Relic binding", func() {
+			delete(env, "NEW_RELIC_LICENSE_KEY")
+			delete(env, "NEW_RELIC_DOWNLOAD_URL")
+
+			result := build()
+			Expect(result.Layers).To(BeEmpty())
+			Expect(filepath.Join(layersDir, "newrelic-agent.toml")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(layersDir, "newrelic-env.toml")).NotTo(BeAnExistingFile())
+			Expect(httpClient.requests).To(BeEmpty())
+		})
+	})
+
+	Describe("WritableAgentHome", func() {
+		It("links the agent layer and copies newrelic.config", func() {
+			agentDir := filepath.Join(layersDir, "newrelic-agent", "newrelic-dotnet-agent")
+			writeFile(filepath.Join(agentDir, "libNewRelicProfiler.so"), "profiler")
+			writeFile(filepath.Join(agentDir, "newrelic.config"), "<configuration/>")
+			writeFile(filepath.Join(agentDir, "logs", "old.log"), "log")
+			Expect(os.Chmod(filepath.Join(agentDir, "newrelic.config"), 0444)).To(Succeed())
+
+			home, err := cnb.WritableAgentHome(agentDir, filepath.Join(root, "tmp"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(home).To(Equal(filepath.Join(root, "tmp", "newrelic-agent-home")))
+
+			link, err := os.Readlink(filepath.Join(home, "libNewRelicProfiler.so"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(Equal(filepath.Join(agentDir, "libNewRelicProfiler.so")))
+			info, err := os.Lstat(filepath.Join(home, "newrelic.config"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().IsRegular()).To(BeTrue())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+			Expect(ioutil.WriteFile(filepath.Join(home, "newrelic.config"), []byte("<configuration></configuration>"), 0644)).To(Succeed())
+			Expect(filepath.Join(home, "logs")).To(BeADirectory())
+			Expect(filepath.Join(home, "logs", "old.log")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("PlatformEnvironment", func() {
+		It("reads the env vars of the platform dir", func() {
+			platformDir := filepath.Join(root, "platform")
+			writeFile(filepath.Join(platformDir, "env", "NEW_RELIC_APP_NAME"), "my-app")
+			platformEnv := cnb.PlatformEnvironment{PlatformDir: platformDir}
+
+			value, ok := platformEnv.LookupEnv("NEW_RELIC_APP_NAME")
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal("my-app"))
+			Expect(platformEnv.Environ()).To(ContainElement("NEW_RELIC_APP_NAME=my-app"))
+		})
+
+		It("finds the service bindings of the build in the platform dir", func() {
+			platformDir := filepath.Join(root, "platform")
+			platformEnv := cnb.PlatformEnvironment{PlatformDir: platformDir}
+			if _, set := os.LookupEnv("SERVICE_BINDING_ROOT"); set {
+				Skip("SERVICE_BINDING_ROOT is set")
+			}
+
+			_, ok := platformEnv.LookupEnv("SERVICE_BINDING_ROOT")
+			Expect(ok).To(BeFalse())
+
+			writeFile(filepath.Join(platformDir, "bindings", "nr", "type"), "newrelic")
+			value, ok := platformEnv.LookupEnv("SERVICE_BINDING_ROOT")
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal(filepath.Join(platformDir, "bindings")))
+		})
+	})
+})
@@ -0,0 +1,46 @@
+package cnb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PlatformEnvironment is the environment of a cloud native buildpack: the env vars set by the user
+// (i.e. "pack build --env" or the env of a kpack Image) are files in <platform>/env, not process env vars.
+type PlatformEnvironment struct {
+	PlatformDir string
+}
+
+func (e PlatformEnvironment) LookupEnv(name string) (string, bool) {
+	if strings.ContainsAny(name, "/\\") {
+		return "", false
+	}
+	content, err := ioutil.ReadFile(filepath.Join(e.PlatformDir, "env", name))
+	if err == nil {
+		return string(content), true
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	// the lifecycle mounts the service bindings of the build in <platform>/bindings
+	if name == "SERVICE_BINDING_ROOT" {
+		bindings := filepath.Join(e.PlatformDir, "bindings")
+		if info, err := os.Stat(bindings); err == nil && info.IsDir() {
+			return bindings, true
+		}
+	}
+	return "", false
+}
+
+func (e PlatformEnvironment) Environ() []string {
+	environ := os.Environ()
+	files, _ := ioutil.ReadDir(filepath.Join(e.PlatformDir, "env"))
+	for _, file := range files {
+		if value, ok := e.LookupEnv(file.Name()); ok && !file.IsDir() {
+			environ = append(environ, file.Name()+"="+value)
+		}
+	}
+	return environ
+}
@@ -1,7 +1,11 @@
 package finalize
 
 import (
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"path/filepath"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
@@ -42,7 +46,47 @@ type Finalizer struct {
 func (f *Finalizer) Run() error {
 	f.Log.BeginStep("Configuring newrelic-dotnetcore-extension")
 
-	// TODO: Prepare app for launch here here...
+	// all buildpacks supplied the app, verify the agent is still wired up
+	v := &nrbuildpack.Verification{}
+	if !nrbuildpack.VerifyProfiler(f.Stager, v) {
+		f.Log.Info("New Relic agent not installed, nothing to verify")
+		return nil
+	}
+	verifyDotnetRuntime(f, v)
+	return v.Report(f.Log)
+}
+
+// the dotnet-core buildpack installs dotnet in deps/IDX/dotnet-sdk, self-contained apps bring their own runtime
+func verifyDotnetRuntime(f *Finalizer, v *nrbuildpack.Verification) {
+	runtimes, _ := filepath.Glob(filepath.Join(f.Stager.DepsDir(), "*", "dotnet-sdk", "dotnet"))
+	if len(runtimes) > 0 {
+		f.Log.Debug("Found dotnet runtime %s", runtimes[0])
+		return
+	}
+	if selfContainedApp(f.Stager.BuildDir()) {
+		f.Log.Debug("Found self-contained app")
+		return
+	}
+	v.Warn("no dotnet runtime found in the droplet and the app is not self-contained, " +
+		"make sure the dotnet-core buildpack is in the buildpack chain")
+}
 
-	return nil
+// self-contained apps list includedFrameworks instead of frameworks in *.runtimeconfig.json
+func selfContainedApp(buildDir string) bool {
+	configs, _ := filepath.Glob(filepath.Join(buildDir, "*.runtimeconfig.json"))
+	for _, config := range configs {
+		content, err := ioutil.ReadFile(config)
+		if err != nil {
+			continue
+		}
+		var runtimeConfig struct {
+			RuntimeOptions struct {
+				IncludedFrameworks []interface{} `json:"includedFrameworks"`
+			} `json:"runtimeOptions"`
+		}
+		if err := json.Unmarshal(content, &runtimeConfig); err == nil && len(runtimeConfig.RuntimeOptions.IncludedFrameworks) > 0 {
+			return true
+		}
+	}
+	return false
 }
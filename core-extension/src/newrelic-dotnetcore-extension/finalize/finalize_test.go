@@ -2,13 +2,98 @@ package finalize_test
 
 //go:generate mockgen -source=finalize.go --destination=mocks_test.go --package=finalize_test
 import (
+	"bytes"
+	"io/ioutil"
+	"newrelic-dotnetcore-extension/finalize"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// fakeStager lays out the staging folders in a temp folder
+type fakeStager struct {
+	root string
+}
+
+func (s *fakeStager) BuildDir() string { return filepath.Join(s.root, "app") }
+func (s *fakeStager) DepDir() string   { return filepath.Join(s.DepsDir(), s.DepsIdx()) }
+func (s *fakeStager) DepsIdx() string  { return "1" }
+func (s *fakeStager) DepsDir() string  { return filepath.Join(s.root, "deps") }
+
 var _ = Describe("Finalize", func() {
 	It("succeeds", func() {
 		Expect(false).To(Equal(false))
 	})
-	// TODO: Add tests here to check configure dependency functions work
+
+	var (
+		stager    *fakeStager
+		buffer    *bytes.Buffer
+		finalizer *finalize.Finalizer
+	)
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		root, err := ioutil.TempDir("", "finalize")
+		Expect(err).NotTo(HaveOccurred())
+		stager = &fakeStager{root: root}
+		buffer = new(bytes.Buffer)
+		finalizer = &finalize.Finalizer{Stager: stager, Log: libbuildpack.NewLogger(buffer)}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(stager.root)).To(Succeed())
+	})
+
+	It("does nothing when the agent wasn't installed", func() {
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("nothing to verify"))
+	})
+
+	Context("with the agent installed by supply", func() {
+		BeforeEach(func() {
+			script := filepath.Join(stager.DepDir(), "profile.d", "newrelic.sh")
+			writeFile(script, "export CORECLR_PROFILER_PATH=\"${DEPS_DIR}/1/newrelic-dotnet-agent/libNewRelicProfiler.so\"\n")
+			writeFile(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", "libNewRelicProfiler.so"), "profiler")
+			writeFile(filepath.Join(stager.DepDir(), "newrelic-profiler.yml"), "script: "+script+"\nvars:\n"+
+				"- name: CORECLR_PROFILER_PATH\n  ref: DEPS_DIR\n  value: /1/newrelic-dotnet-agent/libNewRelicProfiler.so\n  is_path: true\n")
+		})
+
+		It("accepts the dotnet runtime of the dotnet-core buildpack", func() {
+			writeFile(filepath.Join(stager.DepsDir(), "0", "dotnet-sdk", "dotnet"), "")
+
+			Expect(finalizer.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("New Relic agent verified"))
+			Expect(buffer.String()).NotTo(ContainSubstring("WARNING"))
+		})
+
+		It("accepts self-contained apps", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "app.runtimeconfig.json"),
+				`{"runtimeOptions": {"includedFrameworks": [{"name": "Microsoft.NETCore.App", "version": "8.0.0"}]}}`)
+
+			Expect(finalizer.Run()).To(Succeed())
+			Expect(buffer.String()).NotTo(ContainSubstring("WARNING"))
+		})
+
+		It("warns without a dotnet runtime", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "app.runtimeconfig.json"),
+				`{"runtimeOptions": {"framework": {"name": "Microsoft.NETCore.App", "version": "8.0.0"}}}`)
+
+			Expect(finalizer.Run()).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("no dotnet runtime found"))
+		})
+
+		It("fails when the profiler is gone", func() {
+			writeFile(filepath.Join(stager.DepsDir(), "0", "dotnet-sdk", "dotnet"), "")
+			Expect(os.RemoveAll(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent"))).To(Succeed())
+
+			Expect(finalizer.Run()).To(MatchError(ContainSubstring("CORECLR_PROFILER_PATH points to")))
+		})
+	})
 })
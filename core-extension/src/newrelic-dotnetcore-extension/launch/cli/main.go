@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"newrelic-dotnetcore-extension/cnb"
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// newrelic-launch runs from profile.d when the container starts. It prints the script
+// setting the New Relic env vars resolved from the container's environment to stdout.
+// With -format toml it prints the env vars for the exec.d protocol of cloud native buildpacks,
+// with the agent home moved out of the read-only layer of -config.
+func main() {
+	format := flag.String("format", "sh", "script format: sh, cmd or toml")
+	mappingFile := flag.String("mappings", "", "credentials mapping file")
+	newrelicConfigFile := flag.String("config", "", "newrelic.config file to apply the mapped settings to")
+	flag.Parse()
+
+	// stdout is evaluated by the shell, all messages go to stderr
+	redactor := nrbuildpack.NewRedactor(os.Stderr)
+	logger := libbuildpack.NewLogger(redactor)
+
+	dialect := nrbuildpack.PosixShell
+	switch *format {
+	case "toml":
+		// the agent layer is read-only when the app runs, the agent gets a home it can write to
+		home, err := cnb.WritableAgentHome(filepath.Dir(*newrelicConfigFile), os.TempDir())
+		if err != nil {
+			logger.Error("Unable to prepare the New Relic agent home: %s", err.Error())
+			os.Exit(1)
+		}
+		launchEnv, err := nrbuildpack.LaunchEnv(logger, redactor, *mappingFile, filepath.Join(home, "newrelic.config"))
+		if err != nil {
+			logger.Error("Unable to resolve New Relic settings: %s", err.Error())
+			os.Exit(1)
+		}
+		launchEnv["CORECLR_NEWRELIC_HOME"] = home
+		if err := toml.NewEncoder(os.Stdout).Encode(launchEnv); err != nil {
+			logger.Error("Unable to write New Relic settings: %s", err.Error())
+			os.Exit(1)
+		}
+		return
+	case "sh":
+	case "cmd":
+		dialect = nrbuildpack.WindowsBatch
+	default:
+		logger.Error("Unknown script format: %s", *format)
+		os.Exit(1)
+	}
+
+	script, err := nrbuildpack.LaunchScript(logger, redactor, dialect, *mappingFile, *newrelicConfigFile)
+	if err != nil {
+		logger.Error("Unable to resolve New Relic settings: %s", err.Error())
+		os.Exit(1)
+	}
+	fmt.Print(script)
+}
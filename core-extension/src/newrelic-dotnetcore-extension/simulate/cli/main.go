@@ -0,0 +1,12 @@
+package main
+
+import (
+	"newrelic-dotnetcore-extension/nrbuildpack"
+	"newrelic-dotnetcore-extension/supply"
+)
+
+// newrelic-simulate stages an app locally with the supply logic of the extension and a local
+// agent archive, and prints the resulting profile.d script, agent layout and newrelic.config.
+func main() {
+	nrbuildpack.SimulateMain(&supply.Platform{})
+}
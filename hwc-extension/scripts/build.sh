@@ -6,6 +6,9 @@ source .envrc
 
 # GOOS=linux go build -ldflags="-s -w" -o bin/supply newrelic-hwc-extension/supply/cli
 # GOOS=linux go build -ldflags="-s -w" -o bin/finalize newrelic-hwc-extension/finalize/cli
+GOOS=windows go build -ldflags="-s -w" -o bin/detect.exe newrelic-hwc-extension/detect/cli
 GOOS=windows go build -ldflags="-s -w" -o bin/supply.exe newrelic-hwc-extension/supply/cli
 GOOS=windows go build -ldflags="-s -w" -o bin/finalize.exe newrelic-hwc-extension/finalize/cli
+GOOS=windows go build -ldflags="-s -w" -o bin/newrelic-launch.exe newrelic-hwc-extension/launch/cli
+GOOS=windows go build -ldflags="-s -w" -o bin/newrelic-simulate.exe newrelic-hwc-extension/simulate/cli
 
@@ -8,4 +8,5 @@ source .envrc
 ./scripts/install_tools.sh
 
 cd src/*/integration/..
-ginkgo -r -skipPackage=brats,integration
+# nrbuildpack is a symlink to the shared package in lib/, which ginkgo -r does not follow
+ginkgo -r -skipPackage=brats,integration . nrbuildpack
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"newrelic-hwc-extension/nrbuildpack"
+	"os"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// detect <build-dir>: tells if the extension applies to the app, and always exits 1.
+// Cloud Foundry only runs detect to choose the final buildpack, which the extension can't be.
+func main() {
+	if len(os.Args) < 2 {
+		os.Stderr.WriteString("usage: detect <build-dir>\n")
+		os.Exit(2)
+	}
+
+	redactor := nrbuildpack.NewRedactor(os.Stdout)
+	redactor.AddSecretsFromEnv(os.Environ())
+	s := &nrbuildpack.Supplier{Log: libbuildpack.NewLogger(redactor), Redactor: redactor}
+
+	applies, reason := nrbuildpack.Detect(s, os.Args[1])
+	if !applies {
+		s.Log.Info("New Relic extension does not apply: %s", reason)
+		os.Exit(1)
+	}
+	s.Log.Info("New Relic extension applies: %s", reason)
+	s.Log.Warning("New Relic extension is not used: %s", nrbuildpack.FinalBuildpackReason("hwc_buildpack"))
+	os.Exit(1)
+}
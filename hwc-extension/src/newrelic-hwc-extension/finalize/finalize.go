@@ -2,6 +2,9 @@ package finalize
 
 import (
 	"io"
+	"newrelic-hwc-extension/nrbuildpack"
+	"newrelic-hwc-extension/supply"
+	"path/filepath"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
@@ -42,7 +45,27 @@ type Finalizer struct {
 func (f *Finalizer) Run() error {
 	f.Log.BeginStep("Configuring newrelic-hwc-extension")
 
-	// TODO: Prepare app for launch here here...
+	// all buildpacks supplied the app, verify the agent is still wired up
+	v := &nrbuildpack.Verification{}
+	if !nrbuildpack.VerifyProfiler(f.Stager, v) {
+		f.Log.Info("New Relic agent not installed, nothing to verify")
+		return nil
+	}
+	// worker apps run their own executable instead of hwc.exe
+	if nrbuildpack.StagedAppMode(f.Stager) != supply.WorkerMode {
+		verifyHwc(f, v)
+	}
+	return v.Report(f.Log)
+}
 
-	return nil
+// the hwc buildpack puts hwc.exe in .cloudfoundry of the app, or in deps/IDX when it supplies the app
+func verifyHwc(f *Finalizer, v *nrbuildpack.Verification) {
+	hwc := filepath.Join(f.Stager.BuildDir(), ".cloudfoundry", "hwc.exe")
+	if exists, err := libbuildpack.FileExists(hwc); err == nil && exists {
+		return
+	}
+	if supplied, _ := filepath.Glob(filepath.Join(f.Stager.DepsDir(), "*", "hwc.exe")); len(supplied) > 0 {
+		return
+	}
+	v.Warn("hwc.exe not found in the droplet, make sure the hwc buildpack is in the buildpack chain")
 }
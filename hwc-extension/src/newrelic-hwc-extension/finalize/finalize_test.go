@@ -2,13 +2,87 @@ package finalize_test
 
 //go:generate mockgen -source=finalize.go --destination=mocks_test.go --package=finalize_test
 import (
+	"bytes"
+	"io/ioutil"
+	"newrelic-hwc-extension/finalize"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// fakeStager lays out the staging folders in a temp folder
+type fakeStager struct {
+	root string
+}
+
+func (s *fakeStager) BuildDir() string { return filepath.Join(s.root, "app") }
+func (s *fakeStager) DepDir() string   { return filepath.Join(s.DepsDir(), s.DepsIdx()) }
+func (s *fakeStager) DepsIdx() string  { return "0" }
+func (s *fakeStager) DepsDir() string  { return filepath.Join(s.root, "deps") }
+
 var _ = Describe("Finalize", func() {
 	It("succeeds", func() {
 		Expect(false).To(Equal(false))
 	})
-	// TODO: Add tests here to check configure dependency functions work
+
+	var (
+		stager    *fakeStager
+		buffer    *bytes.Buffer
+		finalizer *finalize.Finalizer
+	)
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		root, err := ioutil.TempDir("", "finalize")
+		Expect(err).NotTo(HaveOccurred())
+		stager = &fakeStager{root: root}
+		buffer = new(bytes.Buffer)
+		finalizer = &finalize.Finalizer{Stager: stager, Log: libbuildpack.NewLogger(buffer)}
+
+		script := filepath.Join(stager.DepDir(), "profile.d", "newrelic.bat")
+		writeFile(script, "set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\NewRelic.Profiler.dll\"\r\n")
+		writeFile(filepath.Join(stager.DepDir(), "newrelic", "NewRelic.Profiler.dll"), "profiler")
+		writeFile(filepath.Join(stager.DepDir(), "newrelic-profiler.yml"), "script: "+script+"\nvars:\n"+
+			"- name: COR_PROFILER_PATH\n  ref: DEPS_DIR\n  value: \\0\\newrelic\\NewRelic.Profiler.dll\n  is_path: true\n")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(stager.root)).To(Succeed())
+	})
+
+	It("accepts hwc.exe of the hwc buildpack", func() {
+		writeFile(filepath.Join(stager.BuildDir(), ".cloudfoundry", "hwc.exe"), "")
+
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("New Relic agent verified"))
+		Expect(buffer.String()).NotTo(ContainSubstring("WARNING"))
+	})
+
+	It("warns without hwc.exe", func() {
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).To(ContainSubstring("hwc.exe not found"))
+	})
+
+	It("doesn't look for hwc.exe for apps supply staged as workers", func() {
+		record := filepath.Join(stager.DepDir(), "newrelic-profiler.yml")
+		content, err := ioutil.ReadFile(record)
+		Expect(err).NotTo(HaveOccurred())
+		writeFile(record, string(content)+"mode: worker\n")
+
+		Expect(finalizer.Run()).To(Succeed())
+		Expect(buffer.String()).NotTo(ContainSubstring("hwc.exe not found"))
+	})
+
+	It("fails when the profiler is gone", func() {
+		Expect(os.RemoveAll(filepath.Join(stager.DepDir(), "newrelic"))).To(Succeed())
+
+		Expect(finalizer.Run()).To(MatchError(ContainSubstring("COR_PROFILER_PATH points to")))
+	})
 })
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"newrelic-hwc-extension/nrbuildpack"
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// newrelic-launch runs from profile.d when the container starts. It prints the script
+// setting the New Relic env vars resolved from the container's environment to stdout.
+// With -web-config it also adds the New Relic appSettings to Web.config.
+func main() {
+	format := flag.String("format", "cmd", "script format: sh or cmd")
+	mappingFile := flag.String("mappings", "", "credentials mapping file")
+	newrelicConfigFile := flag.String("config", "", "newrelic.config file to apply the mapped settings to")
+	webConfigFile := flag.String("web-config", "", "Web.config file to add the New Relic appSettings to")
+	webConfigOverride := flag.Bool("web-config-override", false, "replace the New Relic appSettings of the app")
+	flag.Parse()
+
+	// stdout is evaluated by the shell, all messages go to stderr
+	redactor := nrbuildpack.NewRedactor(os.Stderr)
+	logger := libbuildpack.NewLogger(redactor)
+
+	dialect := nrbuildpack.PosixShell
+	switch *format {
+	case "sh":
+	case "cmd":
+		dialect = nrbuildpack.WindowsBatch
+	default:
+		logger.Error("Unknown script format: %s", *format)
+		os.Exit(1)
+	}
+
+	settings, err := nrbuildpack.ResolveLaunch(logger, redactor, *mappingFile, *newrelicConfigFile)
+	if err != nil {
+		logger.Error("Unable to resolve New Relic settings: %s", err.Error())
+		os.Exit(1)
+	}
+	script, err := settings.Script(dialect)
+	if err != nil {
+		logger.Error("Unable to write New Relic settings: %s", err.Error())
+		os.Exit(1)
+	}
+	// the profiler is enabled even if Web.config can't be changed
+	if *webConfigFile != "" {
+		set, kept, err := settings.SetAppSettings(*webConfigFile, *webConfigOverride)
+		if err != nil {
+			logger.Warning("Unable to set the New Relic appSettings of %s: %s", *webConfigFile, err.Error())
+		}
+		logger.Debug("Set [%s] and kept [%s] in the appSettings of %s", strings.Join(set, ", "), strings.Join(kept, ", "), *webConfigFile)
+	}
+	fmt.Print(script)
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"newrelic-hwc-extension/nrbuildpack"
+	"newrelic-hwc-extension/supply"
+)
+
+// newrelic-simulate stages an app locally with the supply logic of the extension and a local
+// agent archive, and prints the resulting profile.d script or newrelic-run.cmd, agent layout and newrelic.config.
+func main() {
+	nrbuildpack.SimulateMain(&supply.Platform{})
+}
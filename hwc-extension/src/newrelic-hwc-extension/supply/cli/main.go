@@ -2,6 +2,7 @@ package main
 
 import (
 	_ "newrelic-hwc-extension/hooks"
+	"newrelic-hwc-extension/nrbuildpack"
 	"newrelic-hwc-extension/supply"
 	"os"
 	"path/filepath"
@@ -11,7 +12,10 @@ import (
 )
 
 func main() {
-	logger := libbuildpack.NewLogger(os.Stdout)
+	// all staging output goes through the redactor, so secrets never show up in the logs
+	redactor := nrbuildpack.NewRedactor(os.Stdout)
+	redactor.AddSecretsFromEnv(os.Environ())
+	logger := libbuildpack.NewLogger(redactor)
 
 	buildpackDir, err := libbuildpack.GetBuildpackDir()
 	if err != nil {
@@ -60,12 +64,14 @@ func main() {
 		os.Exit(14)
 	}
 
-	s := supply.Supplier{
-		Manifest: manifest,
+	s := nrbuildpack.Supplier{
+		Manifest:  manifest,
 		Installer: installer,
-		Stager:   stager,
-		Command:  &libbuildpack.Command{},
-		Log:      logger,
+		Stager:    stager,
+		Command:   &libbuildpack.Command{},
+		Log:       logger,
+		Redactor:  redactor,
+		Platform:  &supply.Platform{},
 	}
 
 	err = s.Run()
@@ -74,7 +80,7 @@ func main() {
 		os.Exit(15)
 	}
 
-	if err := stager.WriteConfigYml(nil); err != nil {
+	if err := stager.WriteConfigYml(s.ConfigYml()); err != nil {
 		logger.Error("Error writing config.yml: %s", err.Error())
 		os.Exit(16)
 	}
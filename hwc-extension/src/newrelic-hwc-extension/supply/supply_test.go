@@ -1,15 +1,296 @@
 package supply_test
 
 import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"newrelic-hwc-extension/nrbuildpack"
+	"newrelic-hwc-extension/supply"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 //go:generate mockgen -source=supply.go --destination=mocks_test.go --package=supply_test
 
+// fakeStager lays out the staging folders in a temp folder
+type fakeStager struct {
+	root string
+}
+
+func (s *fakeStager) BuildDir() string { return filepath.Join(s.root, "app") }
+func (s *fakeStager) DepDir() string   { return filepath.Join(s.DepsDir(), s.DepsIdx()) }
+func (s *fakeStager) DepsIdx() string  { return "0" }
+func (s *fakeStager) DepsDir() string  { return filepath.Join(s.root, "deps") }
+func (s *fakeStager) CacheDir() string { return filepath.Join(s.root, "cache") }
+
+func (s *fakeStager) WriteProfileD(scriptName string, scriptContents string) error {
+	profileD := filepath.Join(s.DepDir(), "profile.d")
+	if err := os.MkdirAll(profileD, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(profileD, scriptName), []byte(scriptContents), 0755)
+}
+
+type fakeEnvironment map[string]string
+
+func (e fakeEnvironment) LookupEnv(name string) (string, bool) {
+	value, ok := e[name]
+	return value, ok
+}
+
+func (e fakeEnvironment) Environ() []string { return nil }
+
 var _ = Describe("Supply", func() {
-	It("example test", func() {
-		Expect(false).To(Equal(false))
+	var (
+		stager   *fakeStager
+		env      fakeEnvironment
+		platform *supply.Platform
+		supplier *nrbuildpack.Supplier
+	)
+
+	readFile := func(name string) string {
+		content, err := ioutil.ReadFile(name)
+		Expect(err).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	// writeScriptOfLayout builds the script of the profiler like supply does
+	writeScriptOfLayout := func(newLayout bool) (string, error) {
+		agentRef, agentPath := platform.AgentPath(supplier, platform.AgentDir(supplier, newLayout))
+		script := nrbuildpack.NewScript(platform.Dialect())
+		platform.SetProfilerVars(supplier, script, agentRef, agentPath)
+		return platform.WriteScript(supplier, script)
+	}
+	writeScript := func() (string, error) { return writeScriptOfLayout(true) }
+
+	BeforeEach(func() {
+		root, err := ioutil.TempDir("", "supply")
+		Expect(err).NotTo(HaveOccurred())
+		stager = &fakeStager{root: root}
+		Expect(os.MkdirAll(stager.BuildDir(), 0755)).To(Succeed())
+		env = fakeEnvironment{}
+		platform = &supply.Platform{}
+		buffer := new(bytes.Buffer)
+		redactor := nrbuildpack.NewRedactor(buffer)
+		supplier = &nrbuildpack.Supplier{Stager: stager, Env: env, Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Platform: platform}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(stager.root)).To(Succeed())
+	})
+
+	It("enables the profiler from profile.d and leaves the start command alone", func() {
+		scriptFile, err := writeScript()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(scriptFile).To(Equal(filepath.Join(stager.DepDir(), "profile.d", "newrelic.bat")))
+		Expect(readFile(scriptFile)).To(ContainSubstring("set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netframework\\NewRelic.Profiler.dll\"\r\n"))
+		files, err := ioutil.ReadDir(stager.BuildDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	It("extracts the agent to deps/IDX", func() {
+		archive := filepath.Join(stager.root, "agent.zip")
+		file, err := os.Create(archive)
+		Expect(err).NotTo(HaveOccurred())
+		writer := zip.NewWriter(file)
+		for _, name := range []string{"netframework/NewRelic.Profiler.dll", "netcore/NewRelic.Profiler.dll"} {
+			entry, err := writer.Create(name)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = entry.Write([]byte("profiler"))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(writer.Close()).To(Succeed())
+		Expect(file.Close()).To(Succeed())
+
+		agentDir, err := platform.ExtractAgent(supplier, archive, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(agentDir).To(Equal(filepath.Join(stager.DepDir(), "newrelic", "netframework")))
+		Expect(readFile(filepath.Join(agentDir, "NewRelic.Profiler.dll"))).To(Equal("profiler"))
+		files, err := ioutil.ReadDir(stager.BuildDir())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(BeEmpty())
+	})
+
+	Describe(".Net Core apps", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"), "{}")
+		})
+
+		It("enables the core profiler of the agent", func() {
+			Expect(platform.AgentDir(supplier, true)).To(Equal(filepath.Join(stager.DepDir(), "newrelic", "netcore")))
+
+			scriptFile, err := writeScript()
+			Expect(err).NotTo(HaveOccurred())
+
+			content := readFile(scriptFile)
+			Expect(content).To(ContainSubstring("set \"CORECLR_NEWRELIC_HOME=%DEPS_DIR%\\0\\newrelic\\netcore\"\r\n"))
+			Expect(content).To(ContainSubstring("set \"CORECLR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netcore\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(content).To(ContainSubstring("set \"CORECLR_PROFILER={36032161-FFC0-4B61-B559-F6C5D41BAE5A}\"\r\n"))
+			Expect(content).NotTo(ContainSubstring("COR_PROFILER"))
+		})
+
+		It("enables both profilers for a framework site hosting a core app", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "web.config"), "<configuration/>")
+			Expect(platform.AgentDir(supplier, true)).To(Equal(filepath.Join(stager.DepDir(), "newrelic", "netframework")))
+
+			scriptFile, err := writeScript()
+			Expect(err).NotTo(HaveOccurred())
+
+			content := readFile(scriptFile)
+			Expect(content).To(ContainSubstring("set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netframework\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(content).To(ContainSubstring("set \"CORECLR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netcore\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(platform.AgentRoot(supplier, platform.AgentDir(supplier, true))).To(Equal(filepath.Join(stager.DepDir(), "newrelic")))
+		})
+
+		It("falls back to the framework profiler with agents before 10.0", func() {
+			scriptFile, err := writeScriptOfLayout(false)
+			Expect(err).NotTo(HaveOccurred())
+
+			content := readFile(scriptFile)
+			Expect(content).To(ContainSubstring("set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(content).NotTo(ContainSubstring("CORECLR_"))
+		})
+	})
+
+	Describe("worker apps", func() {
+		BeforeEach(func() {
+			env["NEW_RELIC_HWC_WORKER"] = "true"
+			writeFile(filepath.Join(stager.BuildDir(), "Worker.exe"), "worker")
+		})
+
+		It("only sets the framework profiler vars from profile.d", func() {
+			env["NEW_RELIC_HWC_START_WRAPPER"] = "true"
+
+			scriptFile, err := writeScript()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(scriptFile).To(Equal(filepath.Join(stager.DepDir(), "profile.d", "newrelic.bat")))
+			content := readFile(scriptFile)
+			Expect(content).To(ContainSubstring("set \"NEWRELIC_HOME=%DEPS_DIR%\\0\\newrelic\\netframework\"\r\n"))
+			Expect(content).To(ContainSubstring("set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netframework\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(content).NotTo(ContainSubstring("NEWRELIC_INSTALL_PATH"))
+			Expect(filepath.Join(stager.BuildDir(), "Procfile")).NotTo(BeAnExistingFile())
+		})
+
+		It("reports the worker mode for finalize", func() {
+			Expect(platform.AppMode(supplier)).To(Equal(supply.WorkerMode))
+
+			delete(env, "NEW_RELIC_HWC_WORKER")
+			Expect(platform.AppMode(supplier)).To(Equal(""))
+		})
+
+		It("lists the executables of the app in newrelic.config", func() {
+			agentDir := platform.AgentDir(supplier, true)
+			writeFile(filepath.Join(agentDir, "newrelic.config"), "<configuration xmlns=\"urn:newrelic-config\">\n"+
+				"  <instrumentation>\n    <applications>\n      <application name=\"hwc.exe\" />\n    </applications>\n  </instrumentation>\n</configuration>\n")
+
+			Expect(platform.ConfigureAgent(supplier, agentDir)).To(Succeed())
+
+			Expect(readFile(filepath.Join(agentDir, "newrelic.config"))).To(Equal("<configuration xmlns=\"urn:newrelic-config\">\n" +
+				"  <instrumentation>\n    <applications>\n      <application name=\"hwc.exe\" />\n      <application name=\"Worker.exe\" />\n" +
+				"    </applications>\n  </instrumentation>\n</configuration>\n"))
+		})
+
+		It("lists the executables of NEW_RELIC_HWC_WORKER_EXECUTABLES", func() {
+			env["NEW_RELIC_HWC_WORKER_EXECUTABLES"] = "Jobs.exe; My Worker.exe"
+			agentDir := platform.AgentDir(supplier, true)
+			writeFile(filepath.Join(agentDir, "newrelic.config"), "<configuration xmlns=\"urn:newrelic-config\"/>")
+
+			Expect(platform.ConfigureAgent(supplier, agentDir)).To(Succeed())
+
+			content := readFile(filepath.Join(agentDir, "newrelic.config"))
+			Expect(content).To(ContainSubstring("<application name=\"Jobs.exe\" />"))
+			Expect(content).To(ContainSubstring("<application name=\"My Worker.exe\" />"))
+			Expect(content).NotTo(ContainSubstring("\"Worker.exe\""))
+		})
+	})
+
+	Describe("Web.config appSettings", func() {
+		const webConfig = "<configuration>\r\n  <appSettings>\r\n    <add key=\"newrelic.appname\" value=\"mine\"/>\r\n  </appSettings>\r\n</configuration>\r\n"
+
+		BeforeEach(func() {
+			env["NEW_RELIC_HWC_WEB_CONFIG_APP_SETTINGS"] = "true"
+			env["NEW_RELIC_APP_NAME"] = "my-app"
+			writeFile(filepath.Join(stager.BuildDir(), "Web.config"), webConfig)
+		})
+
+		It("has the launch helper set them from the profile.d script when the app starts", func() {
+			Expect(platform.ConfigureAgent(supplier, platform.AgentDir(supplier, true))).To(Succeed())
+
+			Expect(platform.LaunchArguments(supplier)).To(Equal([]nrbuildpack.LaunchArgument{
+				{Flag: "-web-config", Ref: "~dp0", Path: "..\\Web.config"},
+			}))
+			Expect(readFile(filepath.Join(stager.BuildDir(), "Web.config"))).To(Equal(webConfig))
+		})
+
+		It("finds Web.config from newrelic-run.cmd in start wrapper mode", func() {
+			env["NEW_RELIC_HWC_START_WRAPPER"] = "true"
+			env["NEW_RELIC_HWC_WEB_CONFIG_OVERRIDE"] = "true"
+
+			Expect(platform.LaunchArguments(supplier)).To(Equal([]nrbuildpack.LaunchArgument{
+				{Flag: "-web-config", Ref: "~dp0", Path: "Web.config"},
+				{Flag: "-web-config-override"},
+			}))
+		})
+
+		It("leaves Web.config alone unless asked", func() {
+			delete(env, "NEW_RELIC_HWC_WEB_CONFIG_APP_SETTINGS")
+
+			Expect(platform.LaunchArguments(supplier)).To(BeEmpty())
+		})
+
+		It("ignores apps without Web.config", func() {
+			Expect(os.Remove(filepath.Join(stager.BuildDir(), "Web.config"))).To(Succeed())
+
+			Expect(platform.LaunchArguments(supplier)).To(BeEmpty())
+		})
+	})
+
+	Describe("start wrapper", func() {
+		BeforeEach(func() {
+			env["NEW_RELIC_HWC_START_WRAPPER"] = "true"
+		})
+
+		It("wraps hwc.exe when the app has no Procfile", func() {
+			scriptFile, err := writeScript()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(scriptFile).To(Equal(filepath.Join(stager.BuildDir(), "newrelic-run.cmd")))
+			content := readFile(scriptFile)
+			Expect(content).To(ContainSubstring("set \"COR_PROFILER_PATH=%DEPS_DIR%\\0\\newrelic\\netframework\\NewRelic.Profiler.dll\"\r\n"))
+			Expect(content).To(HaveSuffix("\r\n:start_app\r\n.cloudfoundry\\hwc.exe\r\n"))
+			Expect(readFile(filepath.Join(stager.BuildDir(), "Procfile"))).To(Equal("web: newrelic-run.cmd\r\n"))
+		})
+
+		It("wraps the web command of the app and keeps its run.cmd", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "run.cmd"), "my start command")
+			writeFile(filepath.Join(stager.BuildDir(), "Procfile"), "worker: worker.exe\nweb: run.cmd --port %PORT%\n")
+
+			scriptFile, err := writeScript()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(readFile(scriptFile)).To(HaveSuffix("\r\n:start_app\r\nrun.cmd --port %PORT%\r\n"))
+			Expect(readFile(filepath.Join(stager.BuildDir(), "Procfile"))).To(Equal("worker: worker.exe\r\nweb: newrelic-run.cmd\r\n"))
+			Expect(readFile(filepath.Join(stager.BuildDir(), "run.cmd"))).To(Equal("my start command"))
+		})
+
+		It("doesn't wrap itself", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "Procfile"), "web: newrelic-run.cmd\n")
+
+			_, err := writeScript()
+			Expect(err).To(MatchError(ContainSubstring("already runs newrelic-run.cmd")))
+		})
 	})
-	// TODO: Add tests here to check install dependency functions work
 })
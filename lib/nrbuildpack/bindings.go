@@ -0,0 +1,98 @@
+package nrbuildpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// root folder of the bindings mounted by platforms following the Service Binding for Kubernetes spec
+const serviceBindingRootEnvVar = "SERVICE_BINDING_ROOT"
+
+// type of the bindings with New Relic credentials
+const newRelicBindingType = "newrelic"
+
+// serviceBinding is a binding folder: every file is a credential named after the file,
+// except "type" and "provider" which describe the binding
+type serviceBinding struct {
+	Name        string
+	Provider    string
+	Credentials map[string]interface{}
+}
+
+// newRelicServiceBindings returns the bindings of type newrelic under SERVICE_BINDING_ROOT, in name order
+func newRelicServiceBindings(s *Supplier) []serviceBinding {
+	root := strings.TrimSpace(s.getenv(serviceBindingRootEnvVar))
+	if root == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.warn("Unable to read service bindings in %s: %s", root, err.Error())
+		}
+		return nil
+	}
+
+	var bindings []serviceBinding
+	for _, entry := range entries {
+		bindingDir := filepath.Join(root, entry.Name())
+		// bindings are usually symlinks to the mounted secret
+		if strings.HasPrefix(entry.Name(), ".") || !isDir(bindingDir) {
+			continue
+		}
+		bindingType, err := readBindingFile(bindingDir, "type")
+		if err != nil || !strings.EqualFold(strings.TrimSpace(bindingType), newRelicBindingType) {
+			continue
+		}
+		binding, err := readServiceBinding(bindingDir)
+		if err != nil {
+			s.warn("Unable to read service binding %s: %s", bindingDir, err.Error())
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings
+}
+
+func readServiceBinding(bindingDir string) (serviceBinding, error) {
+	binding := serviceBinding{Name: filepath.Base(bindingDir), Credentials: make(map[string]interface{})}
+	files, err := ioutil.ReadDir(bindingDir)
+	if err != nil {
+		return binding, err
+	}
+	for _, file := range files {
+		// skip the "..data" folders and links of mounted secrets
+		if strings.HasPrefix(file.Name(), ".") || isDir(filepath.Join(bindingDir, file.Name())) {
+			continue
+		}
+		value, err := readBindingFile(bindingDir, file.Name())
+		if err != nil {
+			return binding, err
+		}
+		switch file.Name() {
+		case "type":
+		case "provider":
+			binding.Provider = strings.TrimSpace(value)
+		default:
+			// "license-key" is the same credential as "license_key"
+			binding.Credentials[strings.Replace(file.Name(), "-", "_", -1)] = value
+		}
+	}
+	return binding, nil
+}
+
+// readBindingFile returns the content of a binding file without the trailing newline editors add
+func readBindingFile(bindingDir string, name string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(bindingDir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
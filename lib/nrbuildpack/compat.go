@@ -0,0 +1,319 @@
+package nrbuildpack
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NEW_RELIC_RUNTIME_CHECK decides what happens when the agent can't profile the .Net runtime of the app:
+// "warn" (default) logs a warning, "fail" fails the staging and "off" skips the check.
+// Unless it is "off", the "latest" agent version installs the newest agent which supports the runtime.
+const runtimeCheckEnvVar = "NEW_RELIC_RUNTIME_CHECK"
+
+const (
+	runtimeCheckWarn = "warn"
+	runtimeCheckFail = "fail"
+	runtimeCheckOff  = "off"
+)
+
+// appRuntime is the target .Net runtime and the publish mode of the app, as far as its files tell
+type appRuntime struct {
+	Framework  string // target framework, i.e. "net8.0" or "netcoreapp3.0"
+	Version    string // major.minor version of .Net Core, "" if unknown
+	NativeAOT  bool
+	SingleFile bool
+	Trimmed    bool
+	Source     string // files the runtime was read from
+}
+
+func (r appRuntime) String() string {
+	description := r.Framework
+	if description == "" {
+		description = "unknown framework"
+	}
+	var modes []string
+	if r.NativeAOT {
+		modes = append(modes, "Native AOT")
+	}
+	if r.Trimmed {
+		modes = append(modes, "trimmed")
+	}
+	if r.SingleFile {
+		modes = append(modes, "single-file")
+	}
+	if len(modes) > 0 {
+		description += " (" + strings.Join(modes, ", ") + ")"
+	}
+	return description
+}
+
+// agentRuntimeSupport is the compatibility matrix of the agent: the oldest .Net Core version profiled
+// by the agents from firstAgent on, newest agents first. lastAgent is the newest agent of an entry
+// which isn't the current one, installed instead of "latest" for the runtimes dropped after it.
+var agentRuntimeSupport = []struct {
+	firstAgent string
+	lastAgent  string
+	minRuntime string
+}{
+	{firstAgent: "10.0.0", minRuntime: "3.1"}, // agent 10.0 dropped .Net Core 2.x and 3.0
+	{firstAgent: "0.0.0", lastAgent: "9.9.0", minRuntime: "2.0"},
+}
+
+// runtimeSupported tells if an agent version can profile the runtime of the app, and why not.
+// Unknown versions are assumed to be compatible.
+func runtimeSupported(agentVersion string, runtime appRuntime) (bool, string) {
+	if runtime.NativeAOT {
+		return false, "Native AOT apps can't be profiled by any agent"
+	}
+	if runtime.Trimmed && runtime.SingleFile {
+		return false, "trimmed single-file apps can't be profiled by any agent"
+	}
+	if agentVersion == "" || runtime.Version == "" {
+		return true, ""
+	}
+	for _, support := range agentRuntimeSupport {
+		if compareVersions(agentVersion, support.firstAgent) < 0 {
+			continue
+		}
+		if compareVersions(runtime.Version, support.minRuntime) < 0 {
+			return false, "agent " + agentVersion + " doesn't support .Net Core " + runtime.Version +
+				", it needs .Net Core " + support.minRuntime + " or later"
+		}
+		break
+	}
+	return true, ""
+}
+
+// newestCompatibleAgent returns the newest agent version of the matrix supporting the runtime,
+// "" if the current agents do or if none does
+func newestCompatibleAgent(runtime appRuntime) string {
+	for _, support := range agentRuntimeSupport {
+		if supported, _ := runtimeSupported(support.firstAgent, runtime); !supported {
+			continue
+		}
+		return support.lastAgent
+	}
+	return ""
+}
+
+// runtimeCheckMode returns NEW_RELIC_RUNTIME_CHECK, "warn" if it is unset or unknown
+func runtimeCheckMode(s *Supplier) string {
+	switch mode := strings.ToLower(strings.TrimSpace(s.getenv(runtimeCheckEnvVar))); mode {
+	case runtimeCheckWarn, runtimeCheckFail, runtimeCheckOff:
+		return mode
+	}
+	return runtimeCheckWarn
+}
+
+// compatibleAgentVersion returns the version to install instead of the latest one:
+// the newest agent supporting the runtime of the app if the latest doesn't
+func compatibleAgentVersion(s *Supplier, latestVersion string) string {
+	if runtimeCheckMode(s) == runtimeCheckOff {
+		return latestVersion
+	}
+	runtime, found := detectAppRuntime(s)
+	if !found {
+		return latestVersion
+	}
+	if supported, _ := runtimeSupported(latestVersion, runtime); supported {
+		return latestVersion
+	}
+	version := newestCompatibleAgent(runtime)
+	if version == "" {
+		return latestVersion
+	}
+	s.Log.Info("Using agent %s instead of the latest agent %s, the newest one supporting %s of the app", version, latestVersion, runtime)
+	return version
+}
+
+// checkRuntimeCompatibility warns, or fails with NEW_RELIC_RUNTIME_CHECK=fail, when the agent
+// can't profile the runtime of the app
+func checkRuntimeCompatibility(s *Supplier, source AgentSource) error {
+	mode := runtimeCheckMode(s)
+	if value := strings.TrimSpace(s.getenv(runtimeCheckEnvVar)); value != "" && !strings.EqualFold(value, mode) {
+		s.warn("Unknown %s \"%s\", using %s", runtimeCheckEnvVar, value, mode)
+	}
+	if mode == runtimeCheckOff {
+		return nil
+	}
+	runtime, found := detectAppRuntime(s)
+	if !found {
+		s.Log.Info("Unable to determine the .Net runtime of the app: no *.runtimeconfig.json, *.deps.json or project file in the app root, skipping the runtime check")
+		return nil
+	}
+	supported, reason := runtimeSupported(source.Version, runtime)
+	if supported {
+		s.Log.Debug("Agent %s supports %s of %s", source.Version, runtime, runtime.Source)
+		return nil
+	}
+
+	message := "incompatible .Net runtime " + runtime.String() + " of " + runtime.Source + ": " + reason
+	if mode == runtimeCheckFail {
+		s.Log.Error("%s", message)
+		return errors.New(message)
+	}
+	s.warn("%s, the app may run without the agent (set %s=fail to fail the staging)", message, runtimeCheckEnvVar)
+	return nil
+}
+
+var (
+	runtimeVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+	frameworkPattern      = regexp.MustCompile(`^net(?:coreapp)?(\d+\.\d+)(?:-\w+)?$`)
+	runtimeTargetPattern  = regexp.MustCompile(`^\.NETCoreApp,Version=v(\d+\.\d+)`)
+)
+
+// detectAppRuntime reads the target runtime of the app from *.runtimeconfig.json or *.deps.json of apps
+// pushed published, and the target framework and publish mode from the project files of apps pushed as
+// source. Supply runs before the dotnet-core buildpack publishes the app, so only the app folder is read.
+func detectAppRuntime(s *Supplier) (appRuntime, bool) {
+	var runtime appRuntime
+	var sources []string
+
+	if file, ok := readRuntimeConfig(s.Stager.BuildDir(), &runtime); ok {
+		sources = append(sources, file)
+	} else if file, ok := readDepsFile(s.Stager.BuildDir(), &runtime); ok {
+		sources = append(sources, file)
+	}
+	if file, ok := readProjectFile(s.Stager.BuildDir(), &runtime); ok {
+		sources = append(sources, file)
+	}
+
+	runtime.Source = strings.Join(sources, ", ")
+	return runtime, len(sources) > 0
+}
+
+// readRuntimeConfig reads the framework of the first *.runtimeconfig.json in dir
+func readRuntimeConfig(dir string, runtime *appRuntime) (string, bool) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.runtimeconfig.json"))
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		type framework struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		var runtimeConfig struct {
+			RuntimeOptions struct {
+				TFM                string      `json:"tfm"`
+				Framework          framework   `json:"framework"`
+				Frameworks         []framework `json:"frameworks"`
+				IncludedFrameworks []framework `json:"includedFrameworks"`
+			} `json:"runtimeOptions"`
+		}
+		if err := json.Unmarshal(content, &runtimeConfig); err != nil {
+			continue
+		}
+		options := runtimeConfig.RuntimeOptions
+		runtime.Framework = options.TFM
+		frameworks := append([]framework{options.Framework}, options.Frameworks...)
+		for _, f := range append(frameworks, options.IncludedFrameworks...) {
+			if f.Name == "Microsoft.NETCore.App" {
+				if match := runtimeVersionPattern.FindStringSubmatch(f.Version); match != nil {
+					runtime.Version = match[1] + "." + match[2]
+				}
+			}
+		}
+		if runtime.Version == "" {
+			if match := frameworkPattern.FindStringSubmatch(runtime.Framework); match != nil {
+				runtime.Version = match[1]
+			}
+		}
+		return filepath.Base(file), true
+	}
+	return "", false
+}
+
+// readDepsFile reads the runtime target of the first *.deps.json in dir
+func readDepsFile(dir string, runtime *appRuntime) (string, bool) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.deps.json"))
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var deps struct {
+			RuntimeTarget struct {
+				Name string `json:"name"`
+			} `json:"runtimeTarget"`
+		}
+		if err := json.Unmarshal(content, &deps); err != nil {
+			continue
+		}
+		match := runtimeTargetPattern.FindStringSubmatch(deps.RuntimeTarget.Name)
+		if match == nil {
+			continue
+		}
+		runtime.Version = match[1]
+		runtime.Framework = "netcoreapp" + match[1]
+		if major, _ := strconv.Atoi(strings.Split(match[1], ".")[0]); major >= 5 {
+			runtime.Framework = "net" + match[1]
+		}
+		return filepath.Base(file), true
+	}
+	return "", false
+}
+
+// readProjectFile reads the target framework and the publish properties of the project file of the app
+func readProjectFile(dir string, runtime *appRuntime) (string, bool) {
+	var files []string
+	for _, extension := range []string{"csproj", "fsproj", "vbproj"} {
+		found, _ := filepath.Glob(filepath.Join(dir, "*."+extension))
+		files = append(files, found...)
+	}
+	if len(files) == 0 {
+		return "", false
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return "", false
+	}
+	project := string(content)
+
+	if runtime.Framework == "" {
+		runtime.Framework = projectProperty(project, "TargetFramework")
+		if match := frameworkPattern.FindStringSubmatch(runtime.Framework); match != nil {
+			runtime.Version = match[1]
+		}
+	}
+	runtime.NativeAOT = strings.EqualFold(projectProperty(project, "PublishAot"), "true")
+	runtime.SingleFile = strings.EqualFold(projectProperty(project, "PublishSingleFile"), "true")
+	runtime.Trimmed = strings.EqualFold(projectProperty(project, "PublishTrimmed"), "true")
+	return filepath.Base(files[0]), true
+}
+
+// projectProperty returns the value of the first <name> property of an msbuild project
+func projectProperty(project string, name string) string {
+	match := regexp.MustCompile(`<` + name + `>\s*([^<]*?)\s*</` + name + `>`).FindStringSubmatch(project)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// compareVersions compares dotted numeric versions, missing parts count as 0
+func compareVersions(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bPart, _ = strconv.Atoi(bParts[i])
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,203 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Runtime compatibility", func() {
+	var (
+		root     string
+		buffer   *bytes.Buffer
+		stager   *fakeStager
+		env      fakeEnvironment
+		supplier *Supplier
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "nrbuildpack-compat")
+		Expect(err).NotTo(HaveOccurred())
+
+		buffer = new(bytes.Buffer)
+		redactor := NewRedactor(buffer)
+		stager = newFakeStager(root)
+		env = fakeEnvironment{}
+		supplier = &Supplier{Stager: stager, Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Env: env}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	Describe("detectAppRuntime", func() {
+		It("reads the framework version of runtimeconfig.json", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"),
+				`{"runtimeOptions":{"tfm":"netcoreapp3.0","framework":{"name":"Microsoft.NETCore.App","version":"3.0.3"}}}`)
+
+			runtime, found := detectAppRuntime(supplier)
+			Expect(found).To(BeTrue())
+			Expect(runtime).To(Equal(appRuntime{Framework: "netcoreapp3.0", Version: "3.0", Source: "App.runtimeconfig.json"}))
+		})
+
+		It("reads the included frameworks of self-contained apps", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"),
+				`{"runtimeOptions":{"tfm":"net8.0","includedFrameworks":[{"name":"Microsoft.NETCore.App","version":"8.0.4"}]}}`)
+
+			runtime, _ := detectAppRuntime(supplier)
+			Expect(runtime.Version).To(Equal("8.0"))
+		})
+
+		It("reads deps.json of published apps without runtimeconfig.json", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.deps.json"),
+				`{"runtimeTarget":{"name":".NETCoreApp,Version=v2.2/linux-x64"}}`)
+
+			runtime, found := detectAppRuntime(supplier)
+			Expect(found).To(BeTrue())
+			Expect(runtime).To(Equal(appRuntime{Framework: "netcoreapp2.2", Version: "2.2", Source: "App.deps.json"}))
+		})
+
+		It("ignores dotnet_publish, the dotnet-core buildpack only writes it after supply", func() {
+			writeFile(filepath.Join(stager.DepsDir(), "1", "dotnet_publish", "App.runtimeconfig.json"),
+				`{"runtimeOptions":{"tfm":"netcoreapp2.2","framework":{"name":"Microsoft.NETCore.App","version":"2.2.0"}}}`)
+
+			_, found := detectAppRuntime(supplier)
+			Expect(found).To(BeFalse())
+		})
+
+		It("reads the target framework and the publish mode of the project file", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.csproj"), `<Project Sdk="Microsoft.NET.Sdk.Web">
+  <PropertyGroup>
+    <TargetFramework>net8.0</TargetFramework>
+    <PublishTrimmed>True</PublishTrimmed>
+    <PublishSingleFile>true</PublishSingleFile>
+  </PropertyGroup>
+</Project>`)
+
+			runtime, found := detectAppRuntime(supplier)
+			Expect(found).To(BeTrue())
+			Expect(runtime).To(Equal(appRuntime{Framework: "net8.0", Version: "8.0", SingleFile: true, Trimmed: true, Source: "App.csproj"}))
+			Expect(runtime.String()).To(Equal("net8.0 (trimmed, single-file)"))
+		})
+
+		It("finds nothing in a .Net Framework app", func() {
+			writeFile(filepath.Join(stager.BuildDir(), "Web.config"), "<configuration/>")
+
+			_, found := detectAppRuntime(supplier)
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("runtimeSupported", func() {
+		supported := func(agentVersion string, runtime appRuntime) bool {
+			ok, _ := runtimeSupported(agentVersion, runtime)
+			return ok
+		}
+
+		It("checks the runtime against the agent matrix", func() {
+			Expect(supported("10.20.1", appRuntime{Version: "3.1"})).To(BeTrue())
+			Expect(supported("9.9.0", appRuntime{Version: "2.1"})).To(BeTrue())
+			Expect(supported("8.21.34.0", appRuntime{Version: "2.0"})).To(BeTrue())
+			Expect(supported("10.0.0", appRuntime{Framework: "net48"})).To(BeTrue())
+
+			ok, reason := runtimeSupported("10.0.0", appRuntime{Version: "3.0"})
+			Expect(ok).To(BeFalse())
+			Expect(reason).To(Equal("agent 10.0.0 doesn't support .Net Core 3.0, it needs .Net Core 3.1 or later"))
+		})
+
+		It("never supports Native AOT and trimmed single-file apps", func() {
+			Expect(supported("10.20.1", appRuntime{Version: "8.0", NativeAOT: true})).To(BeFalse())
+			Expect(supported("10.20.1", appRuntime{Version: "8.0", Trimmed: true, SingleFile: true})).To(BeFalse())
+			Expect(supported("10.20.1", appRuntime{Version: "8.0", SingleFile: true})).To(BeTrue())
+		})
+
+		It("picks the newest agent supporting the runtime", func() {
+			Expect(newestCompatibleAgent(appRuntime{Version: "3.0"})).To(Equal("9.9.0"))
+			Expect(newestCompatibleAgent(appRuntime{Version: "8.0"})).To(Equal(""))
+			Expect(newestCompatibleAgent(appRuntime{Version: "8.0", NativeAOT: true})).To(Equal(""))
+		})
+	})
+
+	Describe("apps pushed as source", func() {
+		BeforeEach(func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.csproj"), `<Project Sdk="Microsoft.NET.Sdk">
+  <PropertyGroup>
+    <TargetFramework>netcoreapp3.0</TargetFramework>
+  </PropertyGroup>
+</Project>`)
+		})
+
+		It("checks the target framework of the project file", func() {
+			err := checkRuntimeCompatibility(supplier, AgentSource{Method: AgentFromVersionEnv, Version: "10.20.1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(buffer.String()).To(ContainSubstring("incompatible .Net runtime netcoreapp3.0 of App.csproj"))
+		})
+
+		It("installs the newest agent supporting the target framework instead of the latest", func() {
+			Expect(compatibleAgentVersion(supplier, "10.20.1")).To(Equal("9.9.0"))
+		})
+
+		It("fails for Native AOT projects with NEW_RELIC_RUNTIME_CHECK=fail", func() {
+			env[runtimeCheckEnvVar] = "fail"
+			writeFile(filepath.Join(stager.BuildDir(), "App.csproj"), `<Project Sdk="Microsoft.NET.Sdk">
+  <PropertyGroup>
+    <TargetFramework>net8.0</TargetFramework>
+    <PublishAot>true</PublishAot>
+  </PropertyGroup>
+</Project>`)
+
+			err := checkRuntimeCompatibility(supplier, AgentSource{Method: AgentFromVersionEnv, Version: "10.20.1"})
+			Expect(err).To(MatchError("incompatible .Net runtime net8.0 (Native AOT) of App.csproj: Native AOT apps can't be profiled by any agent"))
+		})
+	})
+
+	Describe("checkRuntimeCompatibility", func() {
+		source := AgentSource{Method: AgentFromVersionEnv, Version: "10.20.1"}
+
+		BeforeEach(func() {
+			writeFile(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"),
+				`{"runtimeOptions":{"tfm":"netcoreapp3.0","framework":{"name":"Microsoft.NETCore.App","version":"3.0.0"}}}`)
+		})
+
+		It("warns by default", func() {
+			Expect(checkRuntimeCompatibility(supplier, source)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("incompatible .Net runtime netcoreapp3.0 of App.runtimeconfig.json: agent 10.20.1 doesn't support .Net Core 3.0"))
+		})
+
+		It("fails with NEW_RELIC_RUNTIME_CHECK=fail", func() {
+			env[runtimeCheckEnvVar] = "fail"
+
+			err := checkRuntimeCompatibility(supplier, source)
+			Expect(err).To(MatchError(ContainSubstring("incompatible .Net runtime")))
+			category, _ := classifyError(err)
+			Expect(category).To(Equal(ErrorCompatibility))
+		})
+
+		It("tells when the runtime of the app is unknown", func() {
+			Expect(os.Remove(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"))).To(Succeed())
+			writeFile(filepath.Join(stager.BuildDir(), "global.json"), `{"sdk":{"version":"3.0.100"}}`)
+			env[runtimeCheckEnvVar] = "fail"
+
+			Expect(checkRuntimeCompatibility(supplier, source)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("Unable to determine the .Net runtime of the app"))
+		})
+
+		It("is skipped with NEW_RELIC_RUNTIME_CHECK=off", func() {
+			env[runtimeCheckEnvVar] = "off"
+
+			Expect(checkRuntimeCompatibility(supplier, source)).To(Succeed())
+			Expect(buffer.String()).To(BeEmpty())
+		})
+	})
+})
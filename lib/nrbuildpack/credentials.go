@@ -0,0 +1,234 @@
+package nrbuildpack
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// file in the buildpack folder mapping service credentials to agent settings
+const credentialMappingFileName = "credentials.yml"
+
+// env var that points to an operator provided mapping file (absolute, or relative to the app folder)
+const credentialMappingFileEnvVar = "NEW_RELIC_CREDENTIALS_MAPPING_FILE"
+
+// credentialMappings describes how the credentials of a New Relic service binding
+// are turned into agent env vars or newrelic.config settings
+type credentialMappings struct {
+	PassthroughPrefixes []string            `yaml:"passthrough_prefixes"`
+	Mappings            []credentialMapping `yaml:"mappings"`
+}
+
+type credentialMapping struct {
+	Keys      []string `yaml:"keys"`                // credential keys (case insensitive)
+	Env       string   `yaml:"env,omitempty"`       // agent env var to export the value as
+	Config    string   `yaml:"config,omitempty"`    // newrelic.config path, e.g. "service/proxy@host"
+	Transform string   `yaml:"transform,omitempty"` // boolean, lowercase or uppercase
+	Secret    bool     `yaml:"secret,omitempty"`    // value must never be logged
+}
+
+// built-in mappings, used when the buildpack has no credentials.yml file
+var defaultCredentialMappings = credentialMappings{
+	PassthroughPrefixes: []string{"NEW_RELIC_", "NEWRELIC_"},
+	Mappings: []credentialMapping{
+		{Keys: []string{"LICENSE_KEY", "LICENSEKEY"}, Env: "NEW_RELIC_LICENSE_KEY", Secret: true},
+		{Keys: []string{"APP_NAME", "APPNAME"}, Env: "NEW_RELIC_APP_NAME"},
+		{Keys: []string{"DISTRIBUTED_TRACING", "DISTRIBUTEDTRACING"}, Env: "NEW_RELIC_DISTRIBUTED_TRACING_ENABLED", Transform: "boolean"},
+	},
+}
+
+// env var names exported from credentials must be plain shell identifiers
+var envVarNamePattern = regexp.MustCompile("^[A-Z_][A-Z0-9_]*$")
+
+// env vars locating the agent and its profiler are set by the buildpack, a service binding must not
+// point them elsewhere even though they have a pass-through prefix
+var reservedEnvVarNames = []string{"NEWRELIC_HOME", "NEWRELIC_INSTALL_PATH", "NEW_RELIC_HOME", "NEW_RELIC_INSTALL_PATH"}
+
+// loadCredentialMappings reads the buildpack's credentials.yml and the operator's override file if any.
+// Mappings from the override file take precedence over the buildpack's mappings for the same keys.
+func loadCredentialMappings(s *Supplier, buildpackDir string) error {
+	mappings := defaultCredentialMappings
+
+	mappingFiles := []string{filepath.Join(buildpackDir, credentialMappingFileName)}
+	if overrideFile := strings.TrimSpace(s.getenv(credentialMappingFileEnvVar)); overrideFile != "" {
+		if !filepath.IsAbs(overrideFile) {
+			overrideFile = filepath.Join(s.Stager.BuildDir(), overrideFile)
+		}
+		mappingFiles = append(mappingFiles, overrideFile)
+	}
+
+	for i, mappingFile := range mappingFiles {
+		exists, err := libbuildpack.FileExists(mappingFile)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if i > 0 {
+				return errors.New("credentials mapping file " + mappingFile + " does not exist")
+			}
+			continue
+		}
+
+		fileMappings, err := loadCredentialMappingFile(mappingFile)
+		if err != nil {
+			s.Log.Error("Unable to load credentials mapping file %s", mappingFile)
+			return err
+		}
+		s.Log.Debug("Using credentials mapping file %s", mappingFile)
+
+		if i == 0 {
+			// the buildpack's file replaces the built-in mappings
+			mappings = fileMappings
+		} else {
+			mappings = mergeCredentialMappings(mappings, fileMappings)
+		}
+	}
+
+	s.credentialMappings = &mappings
+	return nil
+}
+
+// activeCredentialMappings returns the loaded mappings, or the built-in ones
+func activeCredentialMappings(s *Supplier) credentialMappings {
+	if s.credentialMappings == nil {
+		return defaultCredentialMappings
+	}
+	return *s.credentialMappings
+}
+
+func loadCredentialMappingFile(mappingFile string) (credentialMappings, error) {
+	var mappings credentialMappings
+	if err := libbuildpack.NewYAML().Load(mappingFile, &mappings); err != nil {
+		return mappings, err
+	}
+	return mappings, validateCredentialMappings(mappings)
+}
+
+func validateCredentialMappings(mappings credentialMappings) error {
+	for _, mapping := range mappings.Mappings {
+		if len(mapping.Keys) == 0 {
+			return errors.New("mapping without credential keys")
+		}
+		if (mapping.Env == "") == (mapping.Config == "") {
+			return errors.New("mapping for " + mapping.Keys[0] + " must have either env or config")
+		}
+		if mapping.Env != "" && !envVarNamePattern.MatchString(mapping.Env) {
+			return errors.New("mapping for " + mapping.Keys[0] + " has invalid env var name " + mapping.Env)
+		}
+		if in_array(mapping.Env, reservedEnvVarNames) {
+			return errors.New("mapping for " + mapping.Keys[0] + " can't set " + mapping.Env + ", it is set by the buildpack")
+		}
+		if !in_array(mapping.Transform, []string{"", "boolean", "lowercase", "uppercase"}) {
+			return errors.New("mapping for " + mapping.Keys[0] + " has unknown transform " + mapping.Transform)
+		}
+	}
+	return nil
+}
+
+// mergeCredentialMappings puts override mappings in front, so they are found first by findCredentialMapping
+func mergeCredentialMappings(base, override credentialMappings) credentialMappings {
+	merged := credentialMappings{
+		PassthroughPrefixes: base.PassthroughPrefixes,
+		Mappings:            append(append([]credentialMapping{}, override.Mappings...), base.Mappings...),
+	}
+	if override.PassthroughPrefixes != nil {
+		merged.PassthroughPrefixes = override.PassthroughPrefixes
+	}
+	return merged
+}
+
+func findCredentialMapping(s *Supplier, key string) (credentialMapping, bool) {
+	mappings := activeCredentialMappings(s)
+	upperKey := strings.ToUpper(strings.TrimSpace(key))
+	for _, mapping := range mappings.Mappings {
+		for _, mappingKey := range mapping.Keys {
+			if strings.ToUpper(mappingKey) == upperKey {
+				return mapping, true
+			}
+		}
+	}
+	for _, prefix := range mappings.PassthroughPrefixes {
+		if strings.HasPrefix(upperKey, strings.ToUpper(prefix)) && envVarNamePattern.MatchString(upperKey) && !in_array(upperKey, reservedEnvVarNames) {
+			return credentialMapping{Keys: []string{key}, Env: upperKey}, true
+		}
+	}
+	return credentialMapping{}, false
+}
+
+// credentialValue converts a credential value from VCAP_SERVICES json to its string representation
+func credentialValue(cred interface{}) (string, bool) {
+	switch value := cred.(type) {
+	case nil:
+		return "", true
+	case string:
+		return value, true
+	case bool:
+		return strconv.FormatBool(value), true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", false
+		}
+		return string(encoded), true
+	}
+	return "", false
+}
+
+func transformCredentialValue(transform string, value string) (string, error) {
+	switch transform {
+	case "boolean":
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true", "yes", "on", "1", "enabled":
+			return "true", nil
+		case "false", "no", "off", "0", "disabled":
+			return "false", nil
+		}
+		return "", errors.New("\"" + value + "\" is not a boolean value")
+	case "lowercase":
+		return strings.ToLower(value), nil
+	case "uppercase":
+		return strings.ToUpper(value), nil
+	}
+	return value, nil
+}
+
+// applyConfigSettings writes the newrelic.config settings resolved from service credentials
+func applyConfigSettings(s *Supplier, newrelicConfigFile string) error {
+	if len(s.configSettings) == 0 {
+		return nil
+	}
+	exists, err := libbuildpack.FileExists(newrelicConfigFile)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		s.warn("No newrelic.config found in %s, ignoring settings mapped from service credentials", filepath.Dir(newrelicConfigFile))
+		return nil
+	}
+
+	newrelicConfig, err := loadXMLFile(newrelicConfigFile)
+	if err != nil {
+		s.Log.Error("Unable to parse %s", newrelicConfigFile)
+		return err
+	}
+	paths := make([]string, 0, len(s.configSettings))
+	for path := range s.configSettings {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		s.Log.Debug("Setting newrelic.config %s from service credentials", path)
+		if err := newrelicConfig.setValue(path, s.configSettings[path]); err != nil {
+			return err
+		}
+	}
+	return newrelicConfig.save(newrelicConfigFile)
+}
@@ -0,0 +1,235 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		root     string
+		buffer   *bytes.Buffer
+		stager   *fakeStager
+		env      fakeEnvironment
+		supplier *Supplier
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "credentials")
+		Expect(err).NotTo(HaveOccurred())
+
+		buffer = new(bytes.Buffer)
+		stager = newFakeStager(root)
+		env = fakeEnvironment{}
+		supplier = &Supplier{Stager: stager, Log: libbuildpack.NewLogger(buffer), Env: env}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	writeFile := func(name string, content string) {
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	Describe("loadCredentialMappings", func() {
+		It("lets the override file take precedence over the buildpack's mappings", func() {
+			writeFile(filepath.Join(root, credentialMappingFileName), `---
+passthrough_prefixes: [NEW_RELIC_]
+mappings:
+- keys: [APP_NAME]
+  env: NEW_RELIC_APP_NAME
+- keys: [PROXY_HOST]
+  config: service/proxy@host
+`)
+			writeFile(filepath.Join(stager.BuildDir(), "mappings.yml"), `---
+mappings:
+- keys: [app_name]
+  env: NEW_RELIC_APP_NAME
+  transform: uppercase
+`)
+			env[credentialMappingFileEnvVar] = "mappings.yml"
+
+			Expect(loadCredentialMappings(supplier, root)).To(Succeed())
+
+			mapping, ok := findCredentialMapping(supplier, "APP_NAME")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Transform).To(Equal("uppercase"))
+			mapping, ok = findCredentialMapping(supplier, "proxy_host")
+			Expect(ok).To(BeTrue())
+			Expect(mapping.Config).To(Equal("service/proxy@host"))
+			// the buildpack's file replaces the built-in mappings, the override file keeps its prefixes
+			_, ok = findCredentialMapping(supplier, "license_key")
+			Expect(ok).To(BeFalse())
+			_, ok = findCredentialMapping(supplier, "NEW_RELIC_LABELS")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("uses the built-in mappings without a credentials.yml", func() {
+			Expect(loadCredentialMappings(supplier, root)).To(Succeed())
+			Expect(activeCredentialMappings(supplier)).To(Equal(defaultCredentialMappings))
+		})
+
+		It("fails on a missing NEW_RELIC_CREDENTIALS_MAPPING_FILE", func() {
+			env[credentialMappingFileEnvVar] = "missing.yml"
+
+			err := loadCredentialMappings(supplier, root)
+			Expect(err).To(MatchError("credentials mapping file " + filepath.Join(stager.BuildDir(), "missing.yml") + " does not exist"))
+		})
+
+		It("fails on an invalid mapping file", func() {
+			writeFile(filepath.Join(root, "mappings.yml"), "mappings:\n- keys: [APP_NAME]\n")
+			env[credentialMappingFileEnvVar] = filepath.Join(root, "mappings.yml")
+
+			Expect(loadCredentialMappings(supplier, root)).To(MatchError("mapping for APP_NAME must have either env or config"))
+		})
+	})
+
+	Describe("validateCredentialMappings", func() {
+		DescribeTable("rejects invalid mappings",
+			func(mapping credentialMapping, message string) {
+				err := validateCredentialMappings(credentialMappings{Mappings: []credentialMapping{mapping}})
+				Expect(err).To(MatchError(message))
+			},
+			Entry("no keys", credentialMapping{Env: "NEW_RELIC_APP_NAME"}, "mapping without credential keys"),
+			Entry("neither env nor config", credentialMapping{Keys: []string{"APP_NAME"}}, "mapping for APP_NAME must have either env or config"),
+			Entry("both env and config", credentialMapping{Keys: []string{"HOST"}, Env: "HOST", Config: "service@host"}, "mapping for HOST must have either env or config"),
+			Entry("invalid env var name", credentialMapping{Keys: []string{"HOST"}, Env: "new-relic-host"}, "mapping for HOST has invalid env var name new-relic-host"),
+			Entry("env var of the buildpack", credentialMapping{Keys: []string{"HOME"}, Env: "NEWRELIC_HOME"}, "mapping for HOME can't set NEWRELIC_HOME, it is set by the buildpack"),
+			Entry("unknown transform", credentialMapping{Keys: []string{"HOST"}, Env: "HOST", Transform: "base64"}, "mapping for HOST has unknown transform base64"),
+		)
+
+		It("accepts the built-in mappings", func() {
+			Expect(validateCredentialMappings(defaultCredentialMappings)).To(Succeed())
+		})
+	})
+
+	Describe("transformCredentialValue", func() {
+		DescribeTable("transforms the credential values",
+			func(transform string, value string, expected string) {
+				Expect(transformCredentialValue(transform, value)).To(Equal(expected))
+			},
+			Entry("boolean true", "boolean", " Yes ", "true"),
+			Entry("boolean false", "boolean", "disabled", "false"),
+			Entry("lowercase", "lowercase", "Info", "info"),
+			Entry("uppercase", "uppercase", "eu01", "EU01"),
+			Entry("no transform", "", " Value ", " Value "),
+		)
+
+		It("fails on a value which is not a boolean", func() {
+			_, err := transformCredentialValue("boolean", "maybe")
+			Expect(err).To(MatchError(`"maybe" is not a boolean value`))
+		})
+	})
+
+	Describe("findCredentialMapping", func() {
+		DescribeTable("maps known keys and New Relic pass-throughs only",
+			func(key string, found bool, env string) {
+				mapping, ok := findCredentialMapping(supplier, key)
+				Expect(ok).To(Equal(found))
+				Expect(mapping.Env).To(Equal(env))
+			},
+			Entry("mapped key", "license_key", true, "NEW_RELIC_LICENSE_KEY"),
+			Entry("mapped key in another case", " LicenseKey ", true, "NEW_RELIC_LICENSE_KEY"),
+			Entry("NEW_RELIC_ pass-through", "NEW_RELIC_LABELS", true, "NEW_RELIC_LABELS"),
+			Entry("lower case pass-through", "newrelic_log_directory", true, "NEWRELIC_LOG_DIRECTORY"),
+			Entry("unknown key", "password", false, ""),
+			Entry("variable of the system", "LD_PRELOAD", false, ""),
+			Entry("agent home of the buildpack", "newrelic_home", false, ""),
+			Entry("agent install path of the buildpack", "NEWRELIC_INSTALL_PATH", false, ""),
+			Entry("pass-through which is no env var name", "NEW_RELIC_LABELS; rm -rf /", false, ""),
+			Entry("pass-through prefix inside the key", "MY_NEW_RELIC_KEY", false, ""),
+		)
+
+		It("passes through nothing without passthrough_prefixes", func() {
+			supplier.credentialMappings = &credentialMappings{Mappings: defaultCredentialMappings.Mappings}
+
+			_, ok := findCredentialMapping(supplier, "NEW_RELIC_LABELS")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("credentialValue", func() {
+		DescribeTable("converts json values to strings",
+			func(cred interface{}, value string, ok bool) {
+				actual, actualOk := credentialValue(cred)
+				Expect(actualOk).To(Equal(ok))
+				Expect(actual).To(Equal(value))
+			},
+			Entry("string", "value", "value", true),
+			Entry("null", nil, "", true),
+			Entry("bool", true, "true", true),
+			Entry("integer number", float64(8080), "8080", true),
+			Entry("decimal number", 0.25, "0.25", true),
+			Entry("object", map[string]interface{}{"b": 1.0, "a": "x"}, `{"a":"x","b":1}`, true),
+			Entry("array", []interface{}{"a", false}, `["a",false]`, true),
+			Entry("unsupported type", 42, "", false),
+		)
+	})
+
+	Describe("parseUserProvidedServices", func() {
+		BeforeEach(func() {
+			supplier.envVars = make(map[string]string)
+			supplier.configSettings = make(map[string]string)
+			supplier.settingOrigins = make(map[string]string)
+		})
+
+		It("exports the New Relic credentials and skips the others", func() {
+			parseUserProvidedServices(supplier, map[string]interface{}{
+				"user-provided": []interface{}{map[string]interface{}{
+					"name": "newrelic",
+					"credentials": map[string]interface{}{
+						"license_key":                           "0123456789abcdef0123456789abcdef01234567",
+						"NEW_RELIC_DISTRIBUTED_TRACING_ENABLED": true,
+						"PATH":                                  "/tmp/evil",
+						"app_name":                              struct{}{},
+					},
+				}},
+			})
+
+			Expect(supplier.envVars).To(Equal(map[string]string{
+				"NEW_RELIC_LICENSE_KEY":                 "0123456789abcdef0123456789abcdef01234567",
+				"NEW_RELIC_DISTRIBUTED_TRACING_ENABLED": "true",
+			}))
+			Expect(buffer.String()).To(ContainSubstring(`Ignoring credential "PATH" of user-provided-service "newrelic": not a known New Relic setting`))
+			Expect(buffer.String()).To(ContainSubstring(`Ignoring credential "app_name" of user-provided-service "newrelic": unsupported value type`))
+		})
+
+		It("never lets a binding move the agent", func() {
+			parseUserProvidedServices(supplier, map[string]interface{}{
+				"user-provided": []interface{}{map[string]interface{}{
+					"name":        "newrelic",
+					"credentials": map[string]interface{}{"NEWRELIC_HOME": "/tmp/evil", "NEW_RELIC_LABELS": "team:a"},
+				}},
+			})
+
+			Expect(supplier.envVars).To(Equal(map[string]string{"NEW_RELIC_LABELS": "team:a"}))
+			Expect(buffer.String()).To(ContainSubstring(`Ignoring credential "NEWRELIC_HOME" of user-provided-service "newrelic": not a known New Relic setting`))
+		})
+
+		It("keeps the credentials mapped to newrelic.config apart", func() {
+			mappings := mergeCredentialMappings(defaultCredentialMappings, credentialMappings{
+				Mappings: []credentialMapping{{Keys: []string{"PROXY_HOST"}, Config: "service/proxy@host"}},
+			})
+			supplier.credentialMappings = &mappings
+
+			parseUserProvidedServices(supplier, map[string]interface{}{
+				"user-provided": []interface{}{map[string]interface{}{
+					"name":        "newrelic",
+					"credentials": map[string]interface{}{"proxy_host": "proxy.example.com"},
+				}},
+			})
+
+			Expect(supplier.envVars).To(BeEmpty())
+			Expect(supplier.configSettings).To(Equal(map[string]string{"service/proxy@host": "proxy.example.com"}))
+		})
+	})
+})
@@ -0,0 +1,53 @@
+package nrbuildpack
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// Detect reports if the extension applies to the app in buildDir when it is used as a
+// standalone or final buildpack: the app must be bound to New Relic and look like a .Net app.
+// The reason says why the buildpack applies or why it does not.
+func Detect(s *Supplier, buildDir string) (bool, string) {
+	binding := newRelicBinding(s)
+	if binding == "" {
+		return false, "no New Relic binding: no NEW_RELIC_LICENSE_KEY or NEW_RELIC_DOWNLOAD_URL env var, " +
+			"no service binding of type " + newRelicBindingType + " in " + serviceBindingRootEnvVar + ", " +
+			"and no newrelic service or user-provided-service with \"newrelic\" in its name in VCAP_SERVICES or " + vcapServicesFilePathEnvVar
+	}
+
+	marker, err := dotnetAppMarker(buildDir)
+	if err != nil {
+		return false, "unable to read the app folder: " + err.Error()
+	}
+	if marker == "" {
+		return false, "not a .Net app: no *.runtimeconfig.json, *.deps.json or Web.config in the app folder"
+	}
+	return true, binding + " and found " + marker
+}
+
+// FinalBuildpackReason tells why an extension which applies to the app still fails detect on Cloud Foundry:
+// detect only runs to choose the single buildpack of an app pushed without buildpacks, and that buildpack
+// has to start the app. runtimeBuildpack is the buildpack which does, i.e. dotnet_core_buildpack.
+func FinalBuildpackReason(runtimeBuildpack string) string {
+	return "an extension can't be the final buildpack, it has no runtime to start the app. " +
+		"Push the app with the extension before " + runtimeBuildpack + ", i.e. cf push -b <NEWRELIC_EXTENSION_BUILDPACK_NAME> -b " + runtimeBuildpack
+}
+
+// dotnetAppMarker returns the first file showing that buildDir contains a .Net app, or "" if there is none
+func dotnetAppMarker(buildDir string) (string, error) {
+	files, err := ioutil.ReadDir(buildDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name := strings.ToLower(file.Name())
+		if strings.HasSuffix(name, ".runtimeconfig.json") || strings.HasSuffix(name, ".deps.json") || name == "web.config" {
+			return file.Name(), nil
+		}
+	}
+	return "", nil
+}
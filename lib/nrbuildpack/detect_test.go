@@ -0,0 +1,90 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Detect", func() {
+	var (
+		buildDir string
+		env      fakeEnvironment
+		supplier *Supplier
+	)
+
+	BeforeEach(func() {
+		var err error
+		buildDir, err = ioutil.TempDir("", "nrbuildpack-detect")
+		Expect(err).NotTo(HaveOccurred())
+
+		env = fakeEnvironment{}
+		redactor := NewRedactor(new(bytes.Buffer))
+		supplier = &Supplier{Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Env: env}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(buildDir)).To(Succeed())
+	})
+
+	addFile := func(name string) {
+		Expect(ioutil.WriteFile(filepath.Join(buildDir, name), []byte("{}"), 0644)).To(Succeed())
+	}
+
+	It("applies to a .Net Core app with a license key", func() {
+		env["NEW_RELIC_LICENSE_KEY"] = "0123456789abcdef0123456789abcdef01234567"
+		addFile("MyApp.runtimeconfig.json")
+
+		applies, reason := Detect(supplier, buildDir)
+		Expect(applies).To(BeTrue())
+		Expect(reason).To(Equal("NEW_RELIC_LICENSE_KEY is set and found MyApp.runtimeconfig.json"))
+	})
+
+	It("applies to a .Net Framework app bound to a user-provided-service", func() {
+		env["VCAP_SERVICES"] = `{"user-provided":[{"name":"my-newrelic","credentials":{}}]}`
+		addFile("web.config")
+
+		applies, reason := Detect(supplier, buildDir)
+		Expect(applies).To(BeTrue())
+		Expect(reason).To(Equal(`bound to user-provided-service "my-newrelic" and found web.config`))
+	})
+
+	It("does not apply without a New Relic binding", func() {
+		env["VCAP_SERVICES"] = `{"user-provided":[{"name":"database","credentials":{}}]}`
+		addFile("MyApp.deps.json")
+
+		applies, reason := Detect(supplier, buildDir)
+		Expect(applies).To(BeFalse())
+		Expect(reason).To(Equal("no New Relic binding: no NEW_RELIC_LICENSE_KEY or NEW_RELIC_DOWNLOAD_URL env var, " +
+			"no service binding of type newrelic in SERVICE_BINDING_ROOT, " +
+			"and no newrelic service or user-provided-service with \"newrelic\" in its name in VCAP_SERVICES or VCAP_SERVICES_FILE_PATH"))
+	})
+
+	It("does not apply to other apps", func() {
+		env["VCAP_SERVICES"] = `{"newrelic":[{"name":"nr","credentials":{}}]}`
+		addFile("package.json")
+		Expect(os.Mkdir(filepath.Join(buildDir, "Web.config"), 0755)).To(Succeed())
+
+		applies, reason := Detect(supplier, buildDir)
+		Expect(applies).To(BeFalse())
+		Expect(reason).To(HavePrefix("not a .Net app"))
+	})
+
+	It("does not apply when the app folder is missing", func() {
+		env["NEW_RELIC_DOWNLOAD_URL"] = "https://artifacts.example.com/newrelic-dotnet-agent_10.20.1_amd64.tar.gz"
+
+		applies, reason := Detect(supplier, filepath.Join(buildDir, "missing"))
+		Expect(applies).To(BeFalse())
+		Expect(reason).To(HavePrefix("unable to read the app folder"))
+	})
+	It("tells to push the app with the runtime buildpack after the extension", func() {
+		reason := FinalBuildpackReason("dotnet_core_buildpack")
+		Expect(reason).To(HavePrefix("an extension can't be the final buildpack"))
+		Expect(reason).To(HaveSuffix("cf push -b <NEWRELIC_EXTENSION_BUILDPACK_NAME> -b dotnet_core_buildpack"))
+	})
+})
@@ -0,0 +1,249 @@
+package nrbuildpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NEW_RELIC_BUILDPACK_DRY_RUN=true makes supply explain what it would install without installing it.
+// The metadata bucket and the SHA256 file of the agent are still read to resolve the latest version.
+const dryRunEnvVar = "NEW_RELIC_BUILDPACK_DRY_RUN"
+
+// explanation is a node of the explain tree: a decision and the rule which made it
+type explanation struct {
+	Item     string
+	Value    string
+	Rule     string
+	Children []*explanation
+}
+
+func (e *explanation) add(item string, value string, rule string) *explanation {
+	child := &explanation{Item: item, Value: value, Rule: rule}
+	e.Children = append(e.Children, child)
+	return child
+}
+
+// lines renders the children of the node as an ascii tree
+func (e *explanation) lines(indent string) []string {
+	var lines []string
+	for i, child := range e.Children {
+		branch, nested := "|-- ", "|   "
+		if i == len(e.Children)-1 {
+			branch, nested = "`-- ", "    "
+		}
+		line := indent + branch + child.Item
+		if child.Value != "" {
+			line += ": " + child.Value
+		}
+		lines = append(lines, line)
+		if child.Rule != "" {
+			lines = append(lines, indent+nested+"  rule: "+child.Rule)
+		}
+		lines = append(lines, child.lines(indent+nested)...)
+	}
+	return lines
+}
+
+// dryRun reports if NEW_RELIC_BUILDPACK_DRY_RUN is set to true
+func dryRun(s *Supplier) bool {
+	enabled, err := transformCredentialValue("boolean", s.getenv(dryRunEnvVar))
+	return err == nil && enabled == "true"
+}
+
+// explainStaging resolves the decisions of Run without downloading the agent or writing to the droplet,
+// and logs them as a tree with the rule which decided each of them
+func explainStaging(s *Supplier) error {
+	tree := &explanation{}
+	defer func() {
+		s.Log.BeginStep("New Relic dry run (%s=true), nothing is downloaded or installed", dryRunEnvVar)
+		for _, line := range tree.lines("") {
+			s.Log.Info("%s", line)
+		}
+	}()
+
+	binding := newRelicBinding(s)
+	if binding == "" {
+		tree.add("service", "not bound", "none of NEW_RELIC_LICENSE_KEY, NEW_RELIC_DOWNLOAD_URL, a newrelic service binding in "+serviceBindingRootEnvVar+", "+
+			"a newrelic service instance or a user-provided-service named *newrelic* in VCAP_SERVICES or "+vcapServicesFilePathEnvVar+", the agent is not installed")
+		return nil
+	}
+	tree.add("service", "bound", binding)
+
+	if agentDisabled(s) {
+		if strings.EqualFold(strings.TrimSpace(s.getenv(skipInstallWhenDisabledEnvVar)), "true") {
+			tree.add("agent", "not installed", agentEnabledEnvVar+"=false and "+skipInstallWhenDisabledEnvVar+"=true")
+			return nil
+		}
+		tree.add("profiler", "disabled", agentEnabledEnvVar+"=false, the agent is installed but the profiler is not enabled")
+	}
+
+	buildpackDir, err := getBuildpackDir(s)
+	if err != nil {
+		s.Log.Error("Unable to install New Relic: %s", err.Error())
+		return err
+	}
+	s.buildpackDir = buildpackDir
+	if err := loadCredentialMappings(s, buildpackDir); err != nil {
+		s.Log.Error("Unable to load credentials mapping: %s", err.Error())
+		return err
+	}
+
+	// resolving the latest version downloads the SHA256 file of the agent, not the agent
+	tmpDir, err := ioutil.TempDir("", "newrelic-dry-run")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	source, err := resolveAgentSource(s, buildpackDir, tmpDir)
+	if err != nil {
+		tree.add("agent", "unresolved", s.Redactor.Redact(err.Error()))
+		return err
+	}
+	s.agentSource = &source
+	explainAgentSource(s, tree.add("agent", "", ""), source)
+	explainRuntime(s, tree, source)
+
+	origin, configFile, err := newRelicConfigOrigin(s, buildpackDir)
+	if err != nil {
+		return err
+	}
+	explainConfigFile(tree, origin, configFile)
+
+	explainExportedEnv(s, tree.add("env", "", "set when the app starts"), source)
+	return nil
+}
+
+func explainAgentSource(s *Supplier, agent *explanation, source AgentSource) {
+	switch source.Method {
+	case AgentFromDownloadURL:
+		agent.add("source", source.Method, "NEW_RELIC_DOWNLOAD_URL is set, it takes precedence over every other source")
+	case AgentFromBuildpackCache:
+		agent.add("source", source.Method, "the manifest of the cached buildpack has the agent archive")
+	case AgentFromVersionEnv:
+		agent.add("source", source.Method, "NEW_RELIC_AGENT_VERSION is set")
+	case AgentLatest:
+		agent.add("source", source.Method, "no NEW_RELIC_DOWNLOAD_URL or NEW_RELIC_AGENT_VERSION, and the manifest asks for the latest version")
+	default:
+		agent.add("source", source.Method, "the manifest has the version and url of the agent")
+	}
+
+	switch {
+	case source.Version == "":
+		agent.add("version", "unknown", "the version can't be told from the url")
+	case source.Method == AgentFromDownloadURL || source.Method == AgentFromBuildpackCache:
+		agent.add("version", source.Version, "taken from the name of the archive")
+	case source.Method == AgentFromVersionEnv:
+		agent.add("version", source.Version, "NEW_RELIC_AGENT_VERSION")
+	case source.Method == AgentLatest:
+		agent.add("version", source.Version, "latest release of the metadata bucket")
+	default:
+		agent.add("version", source.Version, "manifest")
+	}
+
+	if source.File != "" {
+		agent.add("file", source.File, "")
+	} else {
+		agent.add("url", s.Redactor.Redact(source.URL), "")
+	}
+
+	switch {
+	case source.SHA256 == "":
+		agent.add("checksum", VerifiedNone, "no NEW_RELIC_DOWNLOAD_SHA256 for NEW_RELIC_DOWNLOAD_URL, the archive is not verified")
+	case source.Method == AgentFromDownloadURL:
+		agent.add("checksum", source.SHA256, "NEW_RELIC_DOWNLOAD_SHA256")
+	case source.Method == AgentLatest || source.Method == AgentFromVersionEnv:
+		agent.add("checksum", source.SHA256, "SHA256 file published with the release")
+	default:
+		agent.add("checksum", source.SHA256, "manifest")
+	}
+	agent.add("layout", agentLayout(source.NewLayout), "")
+}
+
+func explainRuntime(s *Supplier, tree *explanation, source AgentSource) {
+	mode := runtimeCheckMode(s)
+	if mode == runtimeCheckOff {
+		tree.add("runtime", "not checked", runtimeCheckEnvVar+"=off")
+		return
+	}
+	runtime, found := detectAppRuntime(s)
+	if !found {
+		tree.add("runtime", "unknown", "no *.runtimeconfig.json, *.deps.json or project file in the app")
+		return
+	}
+	if supported, reason := runtimeSupported(source.Version, runtime); !supported {
+		tree.add("runtime", runtime.String(), "read from "+runtime.Source+", "+reason+" (staging will "+mode+")")
+		return
+	}
+	tree.add("runtime", runtime.String(), "read from "+runtime.Source+", supported by the agent")
+}
+
+func agentLayout(newLayout bool) string {
+	if newLayout {
+		return "agent 10.0 and later"
+	}
+	return "before agent 10.0"
+}
+
+func explainConfigFile(tree *explanation, origin string, configFile string) {
+	switch origin {
+	case ConfigFromApp:
+		tree.add("newrelic.config", origin, configFile+" exists, the app folder takes precedence")
+	case ConfigFromBuildpack:
+		tree.add("newrelic.config", origin, "no newrelic.config in the app folder, "+configFile+" exists")
+	default:
+		tree.add("newrelic.config", origin, "no newrelic.config in the app or buildpack folder, the default of the agent is used")
+	}
+}
+
+// explainExportedEnv lists the profiler env vars of the script and the agent settings resolved
+// by the launch helper, with secrets redacted
+func explainExportedEnv(s *Supplier, env *explanation, source AgentSource) {
+	agentDir := filepath.Join(s.Stager.DepDir(), "newrelic-dotnet-agent")
+	if locator, ok := s.Platform.(AgentLocator); ok {
+		agentDir = locator.AgentDir(s, source.NewLayout)
+	}
+	script := NewScript(s.Platform.Dialect())
+	agentRef, agentPath := s.Platform.AgentPath(s, agentDir)
+	s.Platform.SetProfilerVars(s, script, agentRef, agentPath)
+	for _, scriptVar := range script.Vars() {
+		value := scriptVar.Value
+		if scriptVar.Ref != "" {
+			value = scriptVar.Ref + ":" + value
+		}
+		env.add(scriptVar.Name, value, "profiler of the "+s.Platform.AgentName()+" agent")
+	}
+
+	resolveAgentSettings(s)
+	for _, name := range sortedKeys(s.envVars) {
+		value := s.envVars[name]
+		if value == "" {
+			continue
+		}
+		if secretEnvVar(name) {
+			value = "**redacted**"
+		}
+		env.add(name, value, s.settingOrigins[name])
+	}
+	if s.envVars["NEW_RELIC_LICENSE_KEY"] == "" {
+		env.add("NEW_RELIC_LICENSE_KEY", "not set", "no license key in the env, the bound services or the bindings, it must be in newrelic.config")
+	}
+
+	if len(s.configSettings) > 0 {
+		config := env.add("newrelic.config settings", "", "written to newrelic.config of the agent")
+		for _, path := range sortedKeys(s.configSettings) {
+			config.add(path, s.Redactor.Redact(s.configSettings[path]), s.settingOrigins[path])
+		}
+	}
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
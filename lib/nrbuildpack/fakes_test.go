@@ -0,0 +1,231 @@
+package nrbuildpack
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// hand-written fakes for the Supplier's dependencies
+
+// fakeEnvironment is an Environment backed by a map
+type fakeEnvironment map[string]string
+
+func (e fakeEnvironment) LookupEnv(name string) (string, bool) {
+	value, ok := e[name]
+	return value, ok
+}
+
+func (e fakeEnvironment) Environ() []string {
+	environ := make([]string, 0, len(e))
+	for name, value := range e {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+// fakeHTTPClient returns canned responses by url, and 404 for any other url
+type fakeHTTPClient struct {
+	responses map[string]fakeResponse
+	requests  []string
+}
+
+func newFakeHTTPClient() *fakeHTTPClient {
+	return &fakeHTTPClient{responses: make(map[string]fakeResponse)}
+}
+
+func (c *fakeHTTPClient) respond(url string, status int, body string) {
+	c.responses[url] = fakeResponse{status: status, body: body}
+}
+
+func (c *fakeHTTPClient) Get(url string) (*http.Response, error) {
+	c.requests = append(c.requests, url)
+	response, ok := c.responses[url]
+	if !ok {
+		response = fakeResponse{status: http.StatusNotFound}
+	}
+	return &http.Response{
+		StatusCode: response.status,
+		Status:     strconv.Itoa(response.status) + " " + http.StatusText(response.status),
+		Body:       ioutil.NopCloser(strings.NewReader(response.body)),
+	}, nil
+}
+
+// fakeClock advances by step each time it is read
+type fakeClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+// fakeStager lays out the staging folders in a temp folder
+type fakeStager struct {
+	buildDir string
+	depsDir  string
+	depsIdx  string
+	cacheDir string
+}
+
+func newFakeStager(root string) *fakeStager {
+	s := &fakeStager{
+		buildDir: filepath.Join(root, "app"),
+		depsDir:  filepath.Join(root, "deps"),
+		depsIdx:  "0",
+		cacheDir: filepath.Join(root, "cache"),
+	}
+	for _, dir := range []string{s.buildDir, s.DepDir(), s.cacheDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+func (s *fakeStager) BuildDir() string { return s.buildDir }
+func (s *fakeStager) DepDir() string   { return filepath.Join(s.depsDir, s.depsIdx) }
+func (s *fakeStager) DepsIdx() string  { return s.depsIdx }
+func (s *fakeStager) DepsDir() string  { return s.depsDir }
+func (s *fakeStager) CacheDir() string { return s.cacheDir }
+
+func (s *fakeStager) WriteProfileD(scriptName string, scriptContents string) error {
+	return writeToFile(strings.NewReader(scriptContents), filepath.Join(s.DepDir(), "profile.d", scriptName), 0755)
+}
+
+func (s *fakeStager) WriteEnvFile(envVar string, envVal string) error {
+	return writeToFile(strings.NewReader(envVal), filepath.Join(s.DepDir(), "env", envVar), 0644)
+}
+
+// placeholder urls of the fake platform, the version is substituted like the real ones
+const fakeAgentURL = "http://download.example.com/dot_net_agent/previous_releases/9.9.9/newrelic-dotnet-agent_9.9.9_amd64.tar.gz"
+const fakeAgentSha256URL = "http://download.example.com/dot_net_agent/previous_releases/9.9.9/SHA256/newrelic-dotnet-agent_9.9.9_amd64.tar.gz.sha256"
+const fakePreOpenSourceAgentURL = "http://download.example.com/dot_net_agent/previous_releases/9.9.9.9/newrelic-netcore20-agent_9.9.9.9_amd64.tar.gz"
+const fakePreOpenSourceAgentSha256URL = "http://download.example.com/dot_net_agent/previous_releases/9.9.9.9/SHA256/newrelic-netcore20-agent_9.9.9.9_amd64.tar.gz.sha256"
+
+// fakePlatform installs a tar.gz agent in deps/IDX like the core extension
+type fakePlatform struct{}
+
+func (p *fakePlatform) ExtensionName() string { return "Fake" }
+func (p *fakePlatform) AgentName() string     { return "Fake" }
+
+func (p *fakePlatform) AgentURLs(preOpenSource bool) (string, string) {
+	if preOpenSource {
+		return fakePreOpenSourceAgentURL, fakePreOpenSourceAgentSha256URL
+	}
+	return fakeAgentURL, fakeAgentSha256URL
+}
+
+func (p *fakePlatform) ArchiveFileName() string { return "agent.tar.gz" }
+
+func (p *fakePlatform) ExtractAgent(s *Supplier, archive string, newLayout bool) (string, error) {
+	agentFolder := "newrelic-netcore20-agent"
+	if newLayout {
+		agentFolder = "newrelic-dotnet-agent"
+	}
+	if err := libbuildpack.ExtractTarGz(archive, s.Stager.DepDir()); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Stager.DepDir(), agentFolder), nil
+}
+
+func (p *fakePlatform) AgentPath(s *Supplier, agentDir string) (string, string) {
+	return "DEPS_DIR", "/" + path.Join(s.Stager.DepsIdx(), filepath.Base(agentDir))
+}
+
+func (p *fakePlatform) Dialect() ScriptDialect { return PosixShell }
+
+func (p *fakePlatform) SetProfilerVars(s *Supplier, script *Script, ref string, agentPath string) {
+	script.SetEnvPath("CORECLR_NEWRELIC_HOME", ref, agentPath)
+	script.SetEnv("CORECLR_ENABLE_PROFILING", "1")
+}
+
+func (p *fakePlatform) WriteScript(s *Supplier, script *Script) (string, error) {
+	content, err := script.Render()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Stager.DepDir(), "profile.d", "newrelic.sh"), s.Stager.WriteProfileD("newrelic.sh", content)
+}
+
+// fakeRootPlatform is a fakePlatform which extracts the archive to the whole of deps/IDX
+type fakeRootPlatform struct {
+	fakePlatform
+}
+
+func (p *fakeRootPlatform) AgentRoot(s *Supplier, agentDir string) string { return s.Stager.DepDir() }
+
+// fakeModePlatform is a fakePlatform staging every app in the mode it is given
+type fakeModePlatform struct {
+	fakePlatform
+	mode string
+}
+
+func (p *fakeModePlatform) AppMode(s *Supplier) string { return p.mode }
+
+// fakeLaunchPlatform is a fakePlatform passing more arguments to the launch helper
+type fakeLaunchPlatform struct {
+	fakePlatform
+}
+
+func (p *fakeLaunchPlatform) LaunchArguments(s *Supplier) []LaunchArgument {
+	return []LaunchArgument{{Flag: "-web-config", Ref: "HOME", Path: "/Web.config"}, {Flag: "-web-config-override"}}
+}
+
+// agentArchive returns a tar.gz agent with the files in agentFolder
+func agentArchive(agentFolder string, files map[string]string) []byte {
+	archive, err := ioutil.TempFile("", "agent")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(archive.Name())
+
+	gz := gzip.NewWriter(archive)
+	tw := tar.NewWriter(gz)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := &tar.Header{Name: agentFolder + "/" + name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			panic(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gz.Close(); err != nil {
+		panic(err)
+	}
+	archive.Close()
+
+	content, err := ioutil.ReadFile(archive.Name())
+	if err != nil {
+		panic(err)
+	}
+	return content
+}
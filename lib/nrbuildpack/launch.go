@@ -0,0 +1,161 @@
+package nrbuildpack
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// The launch helper resolves the New Relic credentials when the container starts,
+// so rebinding a service, rotating a license key or "cf set-env" only needs a restart,
+// and no license key is stored in the droplet. It is built next to the supply executable.
+const launchHelperName = "newrelic-launch"
+
+// snapshot of the credential mappings used during staging, read by the launch helper
+const launchMappingFileName = "credentials.yml"
+
+// the helper runs where the script runs: windows cells for batch scripts, even if staging ran elsewhere
+func launchHelperExecutable(dialect ScriptDialect) string {
+	if dialect == WindowsBatch {
+		return launchHelperName + ".exe"
+	}
+	return launchHelperName
+}
+
+// installLaunchHelper copies the launch helper and the credential mappings into the agent folder
+func installLaunchHelper(s *Supplier, agentDir string) error {
+	executable := launchHelperExecutable(s.Platform.Dialect())
+	launchHelper := s.LaunchHelper
+	if launchHelper == "" {
+		supplyExecutable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		launchHelper = filepath.Join(filepath.Dir(supplyExecutable), executable)
+	}
+	exists, err := libbuildpack.FileExists(launchHelper)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("launch helper " + launchHelper + " not found")
+	}
+
+	s.Log.Debug("Copying %s to %s", launchHelper, agentDir)
+	if err := libbuildpack.CopyFile(launchHelper, filepath.Join(agentDir, executable)); err != nil {
+		return err
+	}
+	return libbuildpack.NewYAML().Write(filepath.Join(agentDir, launchMappingFileName), activeCredentialMappings(s))
+}
+
+// addLaunchHelperCommands adds the commands running the launch helper to a profile.d or newrelic-run.cmd script.
+// agentRef is the variable the agent folder is relative to, i.e. DEPS_DIR.
+func addLaunchHelperCommands(script *Script, agentRef string, agentDir string, extraArguments ...LaunchArgument) {
+	separator := "/"
+	if script.Dialect == WindowsBatch {
+		separator = "\\"
+	}
+	helper := script.quotedPath(agentRef, agentDir+separator+launchHelperExecutable(script.Dialect))
+	arguments := " -mappings " + script.quotedPath(agentRef, agentDir+separator+launchMappingFileName) +
+		" -config " + script.quotedPath(agentRef, agentDir+separator+"newrelic.config")
+	for _, argument := range extraArguments {
+		arguments += " " + argument.Flag
+		if argument.Path != "" {
+			arguments += " " + script.quotedPath(argument.Ref, argument.Path)
+		}
+	}
+
+	switch script.Dialect {
+	case PosixShell:
+		script.Command("eval \"$(" + helper + " -format sh" + arguments + ")\"")
+	case WindowsBatch:
+		script.Command(helper + " -format cmd" + arguments + " > \"%TEMP%\\newrelic-launch.cmd\"")
+		script.Command("call \"%TEMP%\\newrelic-launch.cmd\"")
+	}
+}
+
+// LaunchSettings are the agent settings resolved by the launch helper when the container starts
+type LaunchSettings struct {
+	Env          map[string]string // env vars to set, the ones already set in the container are left out
+	AppName      string
+	AgentEnabled bool
+}
+
+// ResolveLaunch resolves the agent settings from the environment of the starting container
+// with the same precedence rules as staging. Env vars already set in the container always take
+// precedence and are left alone. Settings mapped to newrelic.config are written to newrelicConfigFile.
+// Nothing is resolved when the agent is disabled with NEW_RELIC_AGENT_ENABLED=false.
+func ResolveLaunch(logger *libbuildpack.Logger, redactor *Redactor, mappingFile string, newrelicConfigFile string) (*LaunchSettings, error) {
+	return resolveLaunch(&Supplier{Log: logger, Redactor: redactor}, mappingFile, newrelicConfigFile)
+}
+
+// resolveLaunch resolves the agent settings from the environment of the supplier
+func resolveLaunch(s *Supplier, mappingFile string, newrelicConfigFile string) (*LaunchSettings, error) {
+	settings := &LaunchSettings{Env: make(map[string]string), AgentEnabled: s.AgentEnabled()}
+	if !settings.AgentEnabled {
+		return settings, nil
+	}
+	s.Redactor.AddSecretsFromEnv(s.env().Environ())
+
+	if mappingFile != "" {
+		mappings, err := loadCredentialMappingFile(mappingFile)
+		if err != nil {
+			return nil, err
+		}
+		s.credentialMappings = &mappings
+	}
+
+	resolveAgentSettings(s)
+
+	for name, value := range s.envVars {
+		if _, set := s.env().LookupEnv(name); !set && value != "" {
+			settings.Env[name] = value
+		}
+	}
+	settings.AppName = s.envVars["NEW_RELIC_APP_NAME"]
+
+	if newrelicConfigFile != "" {
+		if err := applyConfigSettings(s, newrelicConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// Script returns the script setting the env vars
+func (l *LaunchSettings) Script(dialect ScriptDialect) (string, error) {
+	script := NewScript(dialect)
+	script.SetEnvs(l.Env)
+	return script.Render()
+}
+
+// SetAppSettings adds the agent switch and the app name to the <appSettings> of webConfigFile.
+// Keys of the app are kept unless override is set. It returns the keys which were set and the ones which were kept.
+func (l *LaunchSettings) SetAppSettings(webConfigFile string, override bool) ([]string, []string, error) {
+	settings := map[string]string{"NewRelic.AgentEnabled": strconv.FormatBool(l.AgentEnabled)}
+	if l.AppName != "" {
+		settings["NewRelic.AppName"] = l.AppName
+	}
+	return SetAppSettings(webConfigFile, settings, override)
+}
+
+// LaunchScript resolves the agent settings like ResolveLaunch, and returns the script setting them
+func LaunchScript(logger *libbuildpack.Logger, redactor *Redactor, dialect ScriptDialect, mappingFile string, newrelicConfigFile string) (string, error) {
+	settings, err := ResolveLaunch(logger, redactor, mappingFile, newrelicConfigFile)
+	if err != nil {
+		return "", err
+	}
+	return settings.Script(dialect)
+}
+
+// LaunchEnv resolves the agent settings like ResolveLaunch, and returns the env vars to set
+func LaunchEnv(logger *libbuildpack.Logger, redactor *Redactor, mappingFile string, newrelicConfigFile string) (map[string]string, error) {
+	settings, err := ResolveLaunch(logger, redactor, mappingFile, newrelicConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return settings.Env, nil
+}
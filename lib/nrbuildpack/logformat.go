@@ -0,0 +1,165 @@
+package nrbuildpack
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// NEW_RELIC_BUILDPACK_LOG_FORMAT=json makes supply write JSON events instead of the text of libbuildpack.Logger
+const logFormatEnvVar = "NEW_RELIC_BUILDPACK_LOG_FORMAT"
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// categories of the errors failing a staging step
+const (
+	ErrorNetwork       = "network"       // the agent, its checksum or the metadata bucket can't be downloaded
+	ErrorChecksum      = "checksum"      // the agent archive doesn't match its checksum
+	ErrorArchive       = "archive"       // the agent archive can't be extracted
+	ErrorFilesystem    = "filesystem"    // staging folders can't be read or written
+	ErrorConfiguration = "configuration" // env vars, services or config files of the app or buildpack
+	ErrorCompatibility = "compatibility" // the agent can't profile the .Net runtime of the app
+	ErrorUnknown       = "unknown"
+)
+
+var remediationHints = map[string]string{
+	ErrorNetwork:       "Check that staging can reach the agent download site, set NEW_RELIC_DOWNLOAD_URL to a reachable mirror, or use the cached extension buildpack",
+	ErrorChecksum:      "Make sure NEW_RELIC_DOWNLOAD_SHA256 or the sha256 of the manifest matches the agent archive, and that no proxy alters the download",
+	ErrorArchive:       "Make sure NEW_RELIC_DOWNLOAD_URL or the manifest points at the agent archive of this platform",
+	ErrorFilesystem:    "Check the free disk space of the staging container and the permissions of the app folder",
+	ErrorConfiguration: "Check the NEW_RELIC_* env vars, the bound New Relic services, and newrelic.config and credentials.yml of the app and the buildpack",
+	ErrorCompatibility: "Pin NEW_RELIC_AGENT_VERSION to an agent supporting the target framework of the app, publish it without Native AOT or trimming, or set NEW_RELIC_RUNTIME_CHECK=warn",
+	ErrorUnknown:       "Restage with BP_DEBUG=true for details",
+}
+
+// classifyError returns the category of the error of a step and the hint to fix it
+func classifyError(err error) (string, string) {
+	category := ErrorUnknown
+	message := strings.ToLower(err.Error())
+	switch err.(type) {
+	case *url.Error, net.Error:
+		category = ErrorNetwork
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		category = ErrorFilesystem
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		category = ErrorConfiguration
+	default:
+		switch {
+		case strings.Contains(message, "incompatible .net runtime"):
+			category = ErrorCompatibility
+		case strings.Contains(message, "sha256 mismatch"):
+			category = ErrorChecksum
+		case strings.Contains(message, "bad status") || strings.Contains(message, "bad http status"):
+			category = ErrorNetwork
+		case strings.Contains(message, "gzip") || strings.Contains(message, "zip: ") ||
+			strings.Contains(message, "archive/tar") || strings.Contains(message, "unexpected eof"):
+			category = ErrorArchive
+		case strings.Contains(message, "yaml") || strings.Contains(message, "xml") ||
+			strings.Contains(message, "credential") || strings.Contains(message, "version match"):
+			category = ErrorConfiguration
+		}
+	}
+	return category, remediationHints[category]
+}
+
+// jsonLogFormat reports if NEW_RELIC_BUILDPACK_LOG_FORMAT asks for JSON events
+func jsonLogFormat(s *Supplier) bool {
+	format := strings.ToLower(strings.TrimSpace(s.getenv(logFormatEnvVar)))
+	switch format {
+	case "", logFormatText:
+		return false
+	case logFormatJSON:
+		return true
+	}
+	s.warn("Unknown %s \"%s\", using %s", logFormatEnvVar, format, logFormatText)
+	return false
+}
+
+// useJSONLog turns the output of the logger into JSON events until the returned function is called
+func useJSONLog(s *Supplier) func() {
+	writer := &jsonLogWriter{redactor: s.Redactor}
+	writer.out = s.Redactor.swapOutput(writer)
+	s.jsonLog = writer
+	return func() {
+		s.Redactor.swapOutput(writer.out)
+		s.jsonLog = nil
+	}
+}
+
+// logEvent is a line of libbuildpack.Logger
+type logEvent struct {
+	Event   string `json:"event"` // "log"
+	Level   string `json:"level"` // step, info, warning, error, debug or tip
+	Message string `json:"message"`
+}
+
+// stepEvent is a staging step, with the outcome recorded in the staging report
+type stepEvent struct {
+	Event     string `json:"event"` // "step"
+	Extension string `json:"extension"`
+	ReportStep
+}
+
+// headers of libbuildpack.Logger, after removing the colors
+var logLevels = []struct{ header, level string }{
+	{"----->", "step"},
+	{"**ERROR**", "error"},
+	{"**WARNING**", "warning"},
+	{"DEBUG:", "debug"},
+	{"PRO TIP:", "tip"},
+}
+
+var terminalColorPattern = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// jsonLogWriter writes a JSON log event for every message of libbuildpack.Logger,
+// it receives them from the Redactor so they are already redacted
+type jsonLogWriter struct {
+	out      io.Writer
+	redactor *Redactor
+	mutex    sync.Mutex
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(terminalColorPattern.ReplaceAllString(string(p), ""))
+	level := "info"
+	for _, logLevel := range logLevels {
+		if strings.HasPrefix(message, logLevel.header) {
+			level = logLevel.level
+			message = strings.TrimSpace(strings.TrimPrefix(message, logLevel.header))
+			break
+		}
+	}
+	// the logger indents the continuation lines of a message
+	message = strings.Replace(message, "\n       ", "\n", -1)
+	if err := w.write(logEvent{Event: "log", Level: level, Message: message}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write writes an event as a line of JSON, redacted like the rest of the output
+func (w *jsonLogWriter) write(event interface{}) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = io.WriteString(w.out, w.redactor.Redact(string(line))+"\n")
+	return err
+}
+
+// logStep writes the JSON event of a step in JSON log format
+func (s *Supplier) logStep(step ReportStep) {
+	if s.jsonLog != nil {
+		s.jsonLog.write(stepEvent{Event: "step", Extension: s.Platform.ExtensionName(), ReportStep: step})
+	}
+}
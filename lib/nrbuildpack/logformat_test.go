@@ -0,0 +1,51 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON log format", func() {
+	It("writes a JSON event for every message of the logger", func() {
+		buffer := new(bytes.Buffer)
+		redactor := NewRedactor(buffer)
+		redactor.AddSecret("secret-license-key")
+		s := &Supplier{Log: libbuildpack.NewLogger(redactor), Redactor: redactor, Platform: &fakePlatform{}}
+
+		restore := useJSONLog(s)
+		s.Log.BeginStep("Installing")
+		s.Log.Warning("key secret-license-key\nis ignored")
+		s.Log.Error("failed")
+		s.logStep(ReportStep{Name: "install agent", Outcome: StepSucceeded, DurationMs: 12})
+		restore()
+		s.logStep(ReportStep{Name: "ignored", Outcome: StepSucceeded})
+
+		Expect(buffer.String()).To(Equal(`{"event":"log","level":"step","message":"Installing"}` + "\n" +
+			`{"event":"log","level":"warning","message":"key **redacted**\nis ignored"}` + "\n" +
+			`{"event":"log","level":"error","message":"failed"}` + "\n" +
+			`{"event":"step","extension":"Fake","name":"install agent","outcome":"succeeded","duration_ms":12}` + "\n"))
+	})
+
+	It("classifies the errors of the steps", func() {
+		for err, category := range map[error]string{
+			&url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("timeout")}:   ErrorNetwork,
+			errors.New("bad status: 404 Not Found"):                                        ErrorNetwork,
+			errors.New("dependency sha256 mismatch: expected sha256: a, actual sha256: b"): ErrorChecksum,
+			errors.New("gzip: invalid header"):                                             ErrorArchive,
+			&os.PathError{Op: "open", Path: "/app", Err: os.ErrPermission}:                 ErrorFilesystem,
+			errors.New("yaml: line 2: mapping values are not allowed"):                     ErrorConfiguration,
+			errors.New("incompatible .Net runtime net8.0 of App.csproj"):                   ErrorCompatibility,
+			errors.New("something else"):                                                   ErrorUnknown,
+		} {
+			actual, hint := classifyError(err)
+			Expect(actual).To(Equal(category), err.Error())
+			Expect(hint).NotTo(BeEmpty())
+		}
+	})
+})
@@ -0,0 +1,91 @@
+package nrbuildpack
+
+import (
+	"strings"
+)
+
+// env files written for the buildpacks running after this one, they are set during their staging
+const (
+	agentVersionEnvFile = "NEW_RELIC_BUILDPACK_AGENT_VERSION"
+	agentHomeEnvFile    = "NEW_RELIC_BUILDPACK_AGENT_HOME"
+	profilerPathEnvFile = "NEW_RELIC_BUILDPACK_PROFILER_PATH"
+	agentSourceEnvFile  = "NEW_RELIC_BUILDPACK_AGENT_SOURCE"
+)
+
+// EnvFileWriter is implemented by stagers that can pass env vars to the buildpacks running after this one,
+// like libbuildpack.Stager which writes them to deps/IDX/env
+type EnvFileWriter interface {
+	WriteEnvFile(string, string) error
+}
+
+// InstalledAgent describes the agent installed by supply. It is the config of deps/IDX/config.yml,
+// so later buildpacks can find the agent. Paths are the staging paths.
+type InstalledAgent struct {
+	Version      string `yaml:"version"`
+	Home         string `yaml:"home"`
+	ProfilerPath string `yaml:"profiler_path"`
+	Source       string `yaml:"source"` // how the agent was obtained, see AgentSource.Method
+	URL          string `yaml:"url,omitempty"`
+}
+
+// InstalledAgent returns the agent installed by the last Run, or nil if it installed none
+func (s *Supplier) InstalledAgent() *InstalledAgent {
+	return s.installedAgent
+}
+
+// ConfigYml returns the config to write in deps/IDX/config.yml with stager.WriteConfigYml
+func (s *Supplier) ConfigYml() interface{} {
+	if s.installedAgent == nil {
+		return nil
+	}
+	return map[string]interface{}{"agent": s.installedAgent}
+}
+
+// publishInstalledAgent records the installed agent from the paths set by the profiler script,
+// and writes the env files for the next buildpacks if the stager supports them
+func publishInstalledAgent(s *Supplier, scriptFile string, vars []ScriptVar) error {
+	agent := &InstalledAgent{}
+	if s.agentSource != nil {
+		agent.Version = s.agentSource.Version
+		agent.Source = s.agentSource.Method
+		agent.URL = s.Redactor.Redact(s.agentSource.URL)
+	}
+	for _, scriptVar := range vars {
+		if !scriptVar.IsPath {
+			continue
+		}
+		path, ok := resolveScriptPath(s.Stager, scriptFile, scriptVar)
+		if !ok {
+			continue
+		}
+		// a script enabling several profilers sets the one of the agent folder first
+		switch {
+		case strings.HasSuffix(scriptVar.Name, "NEWRELIC_HOME") && agent.Home == "":
+			agent.Home = path
+		case strings.HasSuffix(scriptVar.Name, "PROFILER_PATH") && agent.ProfilerPath == "":
+			agent.ProfilerPath = path
+		}
+	}
+	s.installedAgent = agent
+
+	envWriter, ok := s.Stager.(EnvFileWriter)
+	if !ok {
+		return nil
+	}
+	envFiles := [][2]string{
+		{agentVersionEnvFile, agent.Version},
+		{agentHomeEnvFile, agent.Home},
+		{profilerPathEnvFile, agent.ProfilerPath},
+		{agentSourceEnvFile, agent.Source},
+	}
+	for _, envFile := range envFiles {
+		if envFile[1] == "" {
+			continue
+		}
+		if err := envWriter.WriteEnvFile(envFile[0], envFile[1]); err != nil {
+			s.Log.Error("Unable to write env file %s: %s", envFile[0], err.Error())
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package nrbuildpack
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNrbuildpack(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nrbuildpack Suite")
+}
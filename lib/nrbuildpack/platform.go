@@ -0,0 +1,84 @@
+package nrbuildpack
+
+// Platform is what differs between the extension buildpacks: the agent archive and how it is
+// extracted, where the agent lives in the droplet, the profiler env vars and the script setting them.
+// The staging steps themselves (obtaining the agent, newrelic.config, credentials) are shared.
+type Platform interface {
+	// ExtensionName and AgentName are used in the staging log, i.e. "Dotnet Core" and ".Net Core"
+	ExtensionName() string
+	AgentName() string
+
+	// AgentURLs returns the download url and SHA256 url of the agent with a placeholder version,
+	// which is substituted with the version to install. preOpenSource selects the naming of
+	// agent releases before 8.26, which have four part versions.
+	AgentURLs(preOpenSource bool) (downloadURL string, sha256URL string)
+	// ArchiveFileName is the local file name of the downloaded agent archive
+	ArchiveFileName() string
+	// ExtractAgent extracts the agent archive and returns the agent folder. newLayout is set for
+	// agent 10.0 and later, which changed the folder structure of the archive.
+	ExtractAgent(s *Supplier, archive string, newLayout bool) (string, error)
+
+	// AgentPath returns the agent folder as seen by the running app: a path relative to a
+	// variable of the script (i.e. DEPS_DIR or ~dp0), or an absolute path if ref is empty
+	AgentPath(s *Supplier, agentDir string) (ref string, path string)
+	// Dialect of the script setting the profiler env vars
+	Dialect() ScriptDialect
+	// SetProfilerVars adds the env vars enabling the profiler of the app to the script
+	SetProfilerVars(s *Supplier, script *Script, ref string, path string)
+	// WriteScript adds any platform specific commands, writes the script to the droplet and returns its path
+	WriteScript(s *Supplier, script *Script) (string, error)
+}
+
+// AgentCache is implemented by platforms which keep installed agents between builds
+type AgentCache interface {
+	// CachedAgent returns the folder of the agent if it is already installed, Run skips downloading it then
+	CachedAgent(s *Supplier, source AgentSource) (agentDir string, ok bool)
+}
+
+// SBOMLayer is implemented by platforms with a location of their own for SBOM documents,
+// like the layers of cloud native buildpacks
+type SBOMLayer interface {
+	// SBOMFile returns the path for the document of the format ("cdx.json" or "spdx.json"), or "" for none
+	SBOMFile(s *Supplier, format string) string
+}
+
+// AgentInstallRoot is implemented by platforms whose archives hold more than the agent folder,
+// like the framework and core agents of the .Net Framework archive. The SBOM lists the whole root.
+type AgentInstallRoot interface {
+	// AgentRoot returns the folder the archive was extracted to
+	AgentRoot(s *Supplier, agentDir string) string
+}
+
+// AgentLocator is implemented by platforms which can tell where the agent is extracted before it is,
+// the dry run explains the profiler env vars of that folder
+type AgentLocator interface {
+	// AgentDir returns the folder ExtractAgent extracts the agent to
+	AgentDir(s *Supplier, newLayout bool) string
+}
+
+// AgentConfigurer is implemented by platforms which change the agent configuration for the app,
+// after newrelic.config was copied to the agent folder
+type AgentConfigurer interface {
+	ConfigureAgent(s *Supplier, agentDir string) error
+}
+
+// AppModeReporter is implemented by platforms which stage apps differently depending on the kind of app,
+// the mode is recorded with the profiler script for the finalize checks
+type AppModeReporter interface {
+	// AppMode returns the kind of app supply staged, "" for the default
+	AppMode(s *Supplier) string
+}
+
+// LaunchConfigurer is implemented by platforms which have the launch helper apply the settings it resolves
+// when the container starts to more files of the app than newrelic.config
+type LaunchConfigurer interface {
+	// LaunchArguments returns the extra arguments of the launch helper
+	LaunchArguments(s *Supplier) []LaunchArgument
+}
+
+// LaunchArgument is a flag of the launch helper, followed by a path relative to Ref if Path is set
+type LaunchArgument struct {
+	Flag string // i.e. "-web-config"
+	Ref  string // variable or batch parameter the path is relative to, i.e. "~dp0"
+	Path string
+}
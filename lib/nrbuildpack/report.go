@@ -0,0 +1,162 @@
+package nrbuildpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// report of the staging written by supply in deps/IDX, it is part of the droplet
+const stagingReportFileName = "newrelic-staging-report.json"
+
+// how the agent archive was verified
+const (
+	VerifiedSHA256 = "sha256" // checksum of NEW_RELIC_DOWNLOAD_SHA256, the manifest or the SHA256 file of the release
+	VerifiedNone   = "none"   // no checksum known for the archive
+	VerifiedReused = "reused" // agent of a previous build, verified when it was installed
+)
+
+// where newrelic.config comes from
+const (
+	ConfigFromApp       = "app"
+	ConfigFromBuildpack = "buildpack"
+	ConfigFromAgent     = "agent"
+)
+
+// outcomes of a staging step
+const (
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+)
+
+// StagingReport records what supply installed and why, so it can be told from the droplet
+// which agent an app runs. Secrets are never recorded, exported env vars are listed by name only.
+type StagingReport struct {
+	Extension   string       `json:"extension"`
+	StagedAt    time.Time    `json:"staged_at"`
+	Agent       ReportAgent  `json:"agent"`
+	ConfigFile  string       `json:"config_file"`  // one of the ConfigFrom* origins
+	ExportedEnv []string     `json:"exported_env"` // names of the env vars set when the app starts
+	SBOM        []string     `json:"sbom"`         // SBOM documents of the agent
+	Warnings    []string     `json:"warnings"`
+	Steps       []ReportStep `json:"steps"`
+	DurationMs  int64        `json:"duration_ms"`
+}
+
+type ReportAgent struct {
+	Version      string `json:"version"`
+	Source       string `json:"source"` // one of the Agent* methods
+	URL          string `json:"url,omitempty"`
+	File         string `json:"file,omitempty"` // archive cached in the buildpack
+	SHA256       string `json:"sha256,omitempty"`
+	Verification string `json:"verification"` // one of the Verified* methods
+	Home         string `json:"home,omitempty"`
+}
+
+type ReportStep struct {
+	Name          string `json:"name"`
+	Outcome       string `json:"outcome"`
+	DurationMs    int64  `json:"duration_ms"`
+	Error         string `json:"error,omitempty"`
+	ErrorCategory string `json:"error_category,omitempty"` // one of the Error* categories
+	Remediation   string `json:"remediation,omitempty"`    // hint to fix the error
+}
+
+// Report returns the report of the last Run, or nil if it didn't run past detection
+func (s *Supplier) Report() *StagingReport {
+	return s.report
+}
+
+// warn logs a warning and records it in the report
+func (s *Supplier) warn(format string, args ...interface{}) {
+	s.Log.Warning(format, args...)
+	if s.report != nil {
+		message := strings.TrimSpace(fmt.Sprintf(format, args...))
+		s.report.Warnings = append(s.report.Warnings, s.Redactor.Redact(message))
+	}
+}
+
+// step runs a staging step, records its outcome and duration in the report, and logs it in JSON log format
+func (s *Supplier) step(name string, run func() error) error {
+	start := s.now()
+	err := run()
+	step := ReportStep{Name: name, Outcome: StepSucceeded, DurationMs: milliseconds(s.now().Sub(start))}
+	if err != nil {
+		step.Outcome = StepFailed
+		step.Error = s.Redactor.Redact(err.Error())
+		step.ErrorCategory, step.Remediation = classifyError(err)
+	}
+	if s.report != nil {
+		s.report.Steps = append(s.report.Steps, step)
+	}
+	s.logStep(step)
+	return err
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// reportAgent records the agent source, and how the archive was verified
+func reportAgent(s *Supplier, source AgentSource, agentDir string, reused bool) {
+	verification := VerifiedNone
+	if reused {
+		verification = VerifiedReused
+	} else if source.SHA256 != "" {
+		verification = VerifiedSHA256
+	}
+	s.report.Agent = ReportAgent{
+		Version:      source.Version,
+		Source:       source.Method,
+		URL:          s.Redactor.Redact(source.URL),
+		File:         source.File,
+		SHA256:       source.SHA256,
+		Verification: verification,
+		Home:         agentDir,
+	}
+}
+
+// reportExportedEnv records the names of the env vars set by the profiler script and the launch helper
+func reportExportedEnv(s *Supplier, vars []ScriptVar) {
+	names := make(map[string]bool)
+	for _, scriptVar := range vars {
+		names[scriptVar.Name] = true
+	}
+	for name, value := range s.envVars {
+		if value != "" {
+			names[name] = true
+		}
+	}
+	s.report.ExportedEnv = make([]string, 0, len(names))
+	for name := range names {
+		s.report.ExportedEnv = append(s.report.ExportedEnv, name)
+	}
+	sort.Strings(s.report.ExportedEnv)
+}
+
+// writeStagingReport writes the report in deps/IDX and logs a summary
+func writeStagingReport(s *Supplier) error {
+	content, err := json.MarshalIndent(s.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportFile := filepath.Join(s.Stager.DepDir(), stagingReportFileName)
+	if err := ioutil.WriteFile(reportFile, append(content, '\n'), 0644); err != nil {
+		s.Log.Error("Unable to write the staging report %s: %s", reportFile, err.Error())
+		return err
+	}
+
+	agent := s.report.Agent
+	from := agent.URL
+	if from == "" {
+		from = filepath.Base(agent.File)
+	}
+	s.Log.Info("New Relic agent %s from %s (%s), verification: %s, newrelic.config: %s, %d warning(s)",
+		agent.Version, agent.Source, from, agent.Verification, s.report.ConfigFile, len(s.report.Warnings))
+	s.Log.Info("New Relic staging report: %s", reportFile)
+	return nil
+}
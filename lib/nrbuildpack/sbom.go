@@ -0,0 +1,273 @@
+package nrbuildpack
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOM documents of the installed agent, written by supply in deps/IDX
+const (
+	sbomCycloneDX = "cdx.json"
+	sbomSPDX      = "spdx.json"
+)
+
+const sbomComponentName = "newrelic-dotnet-agent"
+const sbomSupplier = "New Relic"
+const sbomToolName = "newrelic-dotnet-buildpack"
+
+// kinds of the files listed in the SBOM
+const (
+	agentFileProfiler = "profiler"         // native profiler loaded by the runtime
+	agentFileNative   = "native-library"   // other native libraries of the agent
+	agentFileAssembly = "managed-assembly" // .Net assemblies of the agent
+)
+
+// agentFile is a binary of the installed agent
+type agentFile struct {
+	Path   string // relative to the agent folder, with forward slashes
+	Kind   string
+	SHA256 string
+}
+
+// agentFiles returns the profiler binaries and managed assemblies of the agent folder
+func agentFiles(agentDir string) ([]agentFile, error) {
+	var files []agentFile
+	err := filepath.Walk(agentDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		kind := agentFileKind(info.Name())
+		if kind == "" {
+			return nil
+		}
+		sum, err := fileSha256(path)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(agentDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, agentFile{Path: filepath.ToSlash(relative), Kind: kind, SHA256: sum})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, err
+}
+
+func agentFileKind(name string) string {
+	lower := strings.ToLower(name)
+	switch filepath.Ext(lower) {
+	case ".so", ".dylib":
+		if strings.Contains(lower, "profiler") {
+			return agentFileProfiler
+		}
+		return agentFileNative
+	case ".dll":
+		// NewRelic.Profiler.dll is the native profiler of the .Net Framework agent
+		if strings.Contains(lower, "profiler") {
+			return agentFileProfiler
+		}
+		return agentFileAssembly
+	}
+	return ""
+}
+
+// sbomSubject is the installed agent and its provenance
+type sbomSubject struct {
+	Version       string
+	DownloadURL   string // redacted
+	ArchiveSHA256 string
+	Source        string
+	Verification  string
+	Files         []agentFile
+	Created       time.Time
+}
+
+func (subject sbomSubject) purl() string {
+	purl := "pkg:generic/newrelic/" + sbomComponentName
+	if subject.Version != "" {
+		purl += "@" + url.PathEscape(subject.Version)
+	}
+	if subject.DownloadURL != "" {
+		purl += "?download_url=" + url.QueryEscape(subject.DownloadURL)
+	}
+	return purl
+}
+
+// writeSBOM writes the CycloneDX and SPDX documents of the agent in deps/IDX,
+// and where the platform keeps SBOM documents. It returns the written files.
+func writeSBOM(s *Supplier, agentDir string) ([]string, error) {
+	root := agentDir
+	if installRoot, ok := s.Platform.(AgentInstallRoot); ok {
+		root = installRoot.AgentRoot(s, agentDir)
+	}
+	files, err := agentFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	subject := sbomSubject{
+		Version:       s.report.Agent.Version,
+		DownloadURL:   s.report.Agent.URL,
+		ArchiveSHA256: s.archiveSha256,
+		Source:        s.report.Agent.Source,
+		Verification:  s.report.Agent.Verification,
+		Files:         files,
+		Created:       s.report.StagedAt,
+	}
+	if subject.ArchiveSHA256 == "" {
+		subject.ArchiveSHA256 = s.report.Agent.SHA256
+	}
+
+	documents := map[string]interface{}{
+		sbomCycloneDX: cycloneDXDocument(subject),
+		sbomSPDX:      spdxDocument(subject),
+	}
+	var written []string
+	for _, format := range []string{sbomCycloneDX, sbomSPDX} {
+		content, err := json.MarshalIndent(documents[format], "", "  ")
+		if err != nil {
+			return written, err
+		}
+		paths := []string{filepath.Join(s.Stager.DepDir(), sbomComponentName+"."+format)}
+		if layer, ok := s.Platform.(SBOMLayer); ok {
+			if path := layer.SBOMFile(s, format); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		for _, path := range paths {
+			if err := ioutil.WriteFile(path, append(content, '\n'), 0644); err != nil {
+				return written, err
+			}
+			written = append(written, path)
+		}
+	}
+	s.Log.Info("New Relic agent SBOM with %d file(s) written to %s", len(files), strings.Join(written, ", "))
+	return written, nil
+}
+
+func cycloneDXDocument(subject sbomSubject) map[string]interface{} {
+	components := make([]map[string]interface{}, 0, len(subject.Files))
+	for _, file := range subject.Files {
+		components = append(components, map[string]interface{}{
+			"type":     "file",
+			"bom-ref":  "file:" + file.Path,
+			"name":     file.Path,
+			"supplier": map[string]interface{}{"name": sbomSupplier},
+			"hashes":   []map[string]string{{"alg": "SHA-256", "content": file.SHA256}},
+			"properties": []map[string]string{
+				{"name": "newrelic:kind", "value": file.Kind},
+			},
+		})
+	}
+
+	agent := map[string]interface{}{
+		"type":     "library",
+		"bom-ref":  subject.purl(),
+		"supplier": map[string]interface{}{"name": sbomSupplier},
+		"name":     sbomComponentName,
+		"version":  subject.Version,
+		"purl":     subject.purl(),
+		"properties": []map[string]string{
+			{"name": "newrelic:source", "value": subject.Source},
+			{"name": "newrelic:verification", "value": subject.Verification},
+		},
+	}
+	if subject.ArchiveSHA256 != "" {
+		agent["hashes"] = []map[string]string{{"alg": "SHA-256", "content": subject.ArchiveSHA256}}
+	}
+	if subject.DownloadURL != "" {
+		agent["externalReferences"] = []map[string]string{{"type": "distribution", "url": subject.DownloadURL}}
+	}
+
+	return map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.4",
+		"serialNumber": "urn:uuid:" + newUUID(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": subject.Created.Format(time.RFC3339),
+			"tools":     []map[string]string{{"vendor": sbomSupplier, "name": sbomToolName}},
+			"component": agent,
+		},
+		"components": components,
+	}
+}
+
+func spdxDocument(subject sbomSubject) map[string]interface{} {
+	const packageID = "SPDXRef-Package-newrelic-dotnet-agent"
+	agent := map[string]interface{}{
+		"SPDXID":           packageID,
+		"name":             sbomComponentName,
+		"versionInfo":      subject.Version,
+		"supplier":         "Organization: " + sbomSupplier,
+		"downloadLocation": "NOASSERTION",
+		"filesAnalyzed":    false,
+		"licenseConcluded": "NOASSERTION",
+		"licenseDeclared":  "NOASSERTION",
+		"copyrightText":    "NOASSERTION",
+		"comment":          "source: " + subject.Source + ", verification: " + subject.Verification,
+		"externalRefs": []map[string]string{
+			{"referenceCategory": "PACKAGE-MANAGER", "referenceType": "purl", "referenceLocator": subject.purl()},
+		},
+	}
+	if subject.DownloadURL != "" {
+		agent["downloadLocation"] = subject.DownloadURL
+	}
+	if subject.ArchiveSHA256 != "" {
+		agent["checksums"] = []map[string]string{{"algorithm": "SHA256", "checksumValue": subject.ArchiveSHA256}}
+	}
+
+	files := make([]map[string]interface{}, 0, len(subject.Files))
+	relationships := []map[string]string{
+		{"spdxElementId": "SPDXRef-DOCUMENT", "relationshipType": "DESCRIBES", "relatedSpdxElement": packageID},
+	}
+	for i, file := range subject.Files {
+		fileID := fmt.Sprintf("SPDXRef-File-%d", i+1)
+		files = append(files, map[string]interface{}{
+			"SPDXID":           fileID,
+			"fileName":         "./" + file.Path,
+			"fileTypes":        []string{"BINARY"},
+			"checksums":        []map[string]string{{"algorithm": "SHA256", "checksumValue": file.SHA256}},
+			"licenseConcluded": "NOASSERTION",
+			"copyrightText":    "NOASSERTION",
+			"comment":          file.Kind,
+		})
+		relationships = append(relationships, map[string]string{
+			"spdxElementId": packageID, "relationshipType": "CONTAINS", "relatedSpdxElement": fileID,
+		})
+	}
+
+	name := sbomComponentName + "-" + subject.Version
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": "https://newrelic.com/spdxdocs/" + name + "-" + newUUID(),
+		"creationInfo": map[string]interface{}{
+			"created":  subject.Created.Format(time.RFC3339),
+			"creators": []string{"Organization: " + sbomSupplier, "Tool: " + sbomToolName},
+		},
+		"packages":      []map[string]interface{}{agent},
+		"files":         files,
+		"relationships": relationships,
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b) // only fails without an entropy source of the OS
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
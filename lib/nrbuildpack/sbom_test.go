@@ -0,0 +1,88 @@
+package nrbuildpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SBOM", func() {
+	var (
+		agentDir string
+		subject  sbomSubject
+	)
+
+	BeforeEach(func() {
+		var err error
+		agentDir, err = ioutil.TempDir("", "nrbuildpack-sbom")
+		Expect(err).NotTo(HaveOccurred())
+		for name, content := range map[string]string{
+			"libNewRelicProfiler.so":                 "profiler",
+			"NewRelic.Agent.Core.dll":                "core",
+			"netcore/NewRelic.Providers.Wrapper.dll": "wrapper",
+			"linux-arm64/libNewRelicProfiler.so":     "arm profiler",
+			"newrelic.config":                        "<configuration/>",
+			"newrelic-launch":                        "launch helper",
+		} {
+			Expect(os.MkdirAll(filepath.Dir(filepath.Join(agentDir, name)), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(agentDir, name), []byte(content), 0644)).To(Succeed())
+		}
+
+		files, err := agentFiles(agentDir)
+		Expect(err).NotTo(HaveOccurred())
+		subject = sbomSubject{
+			Version:       "10.20.1",
+			DownloadURL:   "https://download.example.com/newrelic-dotnet-agent_10.20.1_amd64.tar.gz",
+			ArchiveSHA256: "abc123",
+			Source:        AgentFromDownloadURL,
+			Verification:  VerifiedSHA256,
+			Files:         files,
+			Created:       time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(agentDir)).To(Succeed())
+	})
+
+	It("lists the profiler binaries and managed assemblies with their hashes", func() {
+		Expect(subject.Files).To(Equal([]agentFile{
+			{Path: "NewRelic.Agent.Core.dll", Kind: agentFileAssembly, SHA256: subject.Files[0].SHA256},
+			{Path: "libNewRelicProfiler.so", Kind: agentFileProfiler, SHA256: subject.Files[1].SHA256},
+			{Path: "linux-arm64/libNewRelicProfiler.so", Kind: agentFileProfiler, SHA256: subject.Files[2].SHA256},
+			{Path: "netcore/NewRelic.Providers.Wrapper.dll", Kind: agentFileAssembly, SHA256: subject.Files[3].SHA256},
+		}))
+		sum, err := fileSha256(filepath.Join(agentDir, "libNewRelicProfiler.so"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(subject.Files[1].SHA256).To(Equal(sum))
+		Expect(agentFileKind("NewRelic.Profiler.dll")).To(Equal(agentFileProfiler))
+	})
+
+	It("describes the agent and its provenance in CycloneDX", func() {
+		document := cycloneDXDocument(subject)
+
+		Expect(document).To(HaveKeyWithValue("bomFormat", "CycloneDX"))
+		Expect(document["serialNumber"]).To(MatchRegexp(`^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+		agent := document["metadata"].(map[string]interface{})["component"].(map[string]interface{})
+		Expect(agent).To(HaveKeyWithValue("version", "10.20.1"))
+		Expect(agent).To(HaveKeyWithValue("purl", "pkg:generic/newrelic/newrelic-dotnet-agent@10.20.1?download_url=https%3A%2F%2Fdownload.example.com%2Fnewrelic-dotnet-agent_10.20.1_amd64.tar.gz"))
+		Expect(agent).To(HaveKeyWithValue("hashes", []map[string]string{{"alg": "SHA-256", "content": "abc123"}}))
+		Expect(agent).To(HaveKeyWithValue("externalReferences", []map[string]string{{"type": "distribution", "url": subject.DownloadURL}}))
+		Expect(document["components"]).To(HaveLen(4))
+	})
+
+	It("describes the agent and its files in SPDX", func() {
+		document := spdxDocument(subject)
+
+		Expect(document).To(HaveKeyWithValue("spdxVersion", "SPDX-2.3"))
+		agent := document["packages"].([]map[string]interface{})[0]
+		Expect(agent).To(HaveKeyWithValue("downloadLocation", subject.DownloadURL))
+		Expect(agent).To(HaveKeyWithValue("checksums", []map[string]string{{"algorithm": "SHA256", "checksumValue": "abc123"}}))
+		Expect(document["files"]).To(HaveLen(4))
+		Expect(document["relationships"]).To(HaveLen(5))
+	})
+})
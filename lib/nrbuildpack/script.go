@@ -0,0 +1,213 @@
+package nrbuildpack
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type ScriptDialect int
+
+const (
+	PosixShell   ScriptDialect = iota // profile.d/*.sh
+	WindowsBatch                      // profile.d/*.bat and newrelic-run.cmd
+)
+
+var scriptEnvVarNamePattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Script renders the env var assignments and commands of a generated profile.d or newrelic-run.cmd script.
+// Values are quoted for the script's dialect, so they are never expanded or interpreted by the shell.
+type Script struct {
+	Dialect ScriptDialect
+	lines   []string
+	vars    []ScriptVar
+	err     error
+	skip    string // env var of the open SkipIf block
+}
+
+func NewScript(dialect ScriptDialect) *Script {
+	return &Script{Dialect: dialect}
+}
+
+// ScriptVar is an env var set by a script, kept so finalize can verify it
+type ScriptVar struct {
+	Name   string `yaml:"name"`
+	Ref    string `yaml:"ref,omitempty"`
+	Value  string `yaml:"value"`
+	IsPath bool   `yaml:"is_path,omitempty"`
+}
+
+// SetEnv sets an env var to a literal value
+func (s *Script) SetEnv(name string, value string) {
+	s.setEnv(name, "", value, false)
+}
+
+// SetEnvPath sets an env var to a path relative to the value of another variable, i.e. $DEPS_DIR.
+// ref is the name of the variable (or a batch parameter like "~dp0"), path is appended literally.
+func (s *Script) SetEnvPath(name string, ref string, path string) {
+	s.setEnv(name, ref, path, true)
+}
+
+func (s *Script) setEnv(name string, ref string, path string, isPath bool) {
+	if !scriptEnvVarNamePattern.MatchString(name) {
+		s.fail(errors.New("invalid env var name \"" + name + "\" in generated script"))
+		return
+	}
+
+	switch s.Dialect {
+	case PosixShell:
+		if ref == "" {
+			s.Command("export " + name + "=" + QuotePosix(path))
+		} else {
+			s.Command("export " + name + "=" + s.quotedPath(ref, path))
+		}
+	case WindowsBatch:
+		if strings.ContainsAny(path, "\r\n") {
+			s.fail(errors.New("value of " + name + " contains a line break, which cannot be set in a batch script"))
+			return
+		}
+		// set "NAME=value" keeps special characters in the value literal
+		quoted := s.quotedPath(ref, path)
+		s.Command("set \"" + name + "=" + quoted[1:])
+	}
+	s.vars = append(s.vars, ScriptVar{Name: name, Ref: ref, Value: path, IsPath: isPath})
+}
+
+// Vars returns the env vars set by the script, in the order they are set
+func (s *Script) Vars() []ScriptVar {
+	return s.vars
+}
+
+// quotedPath renders a path relative to a variable as a double quoted argument
+func (s *Script) quotedPath(ref string, path string) string {
+	switch s.Dialect {
+	case WindowsBatch:
+		if strings.HasPrefix(ref, "~") {
+			return "\"%" + ref + escapeBatch(path) + "\""
+		} else if ref != "" {
+			return "\"%" + ref + "%" + escapeBatch(path) + "\""
+		}
+		return "\"" + escapeBatch(path) + "\""
+	default:
+		if ref != "" {
+			return "\"${" + ref + "}" + escapePosixDoubleQuoted(path) + "\""
+		}
+		return "\"" + escapePosixDoubleQuoted(path) + "\""
+	}
+}
+
+// SetEnvs sets all non-empty env vars in name order, so the script is the same for every staging
+func (s *Script) SetEnvs(envs map[string]string) {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if envs[name] != "" {
+			s.SetEnv(name, envs[name])
+		}
+	}
+}
+
+// Command adds a line to the script as it is
+func (s *Script) Command(line string) {
+	if s.skip != "" && s.Dialect == PosixShell {
+		line = "  " + line
+	}
+	s.lines = append(s.lines, line)
+}
+
+// SkipIf skips the following lines up to EndSkip when the env var is set to value (case insensitive)
+// at the time the script runs. Blocks can't be nested.
+func (s *Script) SkipIf(name string, value string) {
+	if !scriptEnvVarNamePattern.MatchString(name) {
+		s.fail(errors.New("invalid env var name \"" + name + "\" in generated script"))
+		return
+	}
+	if s.skip != "" {
+		s.fail(errors.New("nested skip blocks in generated script"))
+		return
+	}
+
+	switch s.Dialect {
+	case PosixShell:
+		s.Command("if [ \"$(printf '%s' \"${" + name + ":-}\" | tr '[:upper:]' '[:lower:]')\" != " + QuotePosix(strings.ToLower(value)) + " ]; then")
+	case WindowsBatch:
+		s.Command("if /i \"%" + name + "%\"==\"" + escapeBatch(value) + "\" goto :skip_" + name)
+	}
+	s.skip = name
+}
+
+// EndSkip ends the block started by SkipIf
+func (s *Script) EndSkip() {
+	if s.skip == "" {
+		s.fail(errors.New("EndSkip without SkipIf in generated script"))
+		return
+	}
+	name := s.skip
+	s.skip = ""
+
+	switch s.Dialect {
+	case PosixShell:
+		s.Command("fi")
+	case WindowsBatch:
+		s.Command(":skip_" + name)
+	}
+}
+
+func (s *Script) Render() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	if s.skip != "" {
+		return "", errors.New("SkipIf without EndSkip in generated script")
+	}
+	newline := "\n"
+	if s.Dialect == WindowsBatch {
+		newline = "\r\n"
+	}
+	if len(s.lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(s.lines, newline) + newline, nil
+}
+
+func (s *Script) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// QuotePosix single-quotes a value for POSIX shells; single quotes inside the value are closed, escaped and reopened
+func QuotePosix(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// escapePosixDoubleQuoted escapes the characters that are special inside double quotes
+func escapePosixDoubleQuoted(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return replacer.Replace(value)
+}
+
+// escapeBatch escapes a value for the inside of set "NAME=value".
+// %% is needed everywhere in a batch file. Characters like & | < > ^ are literal while inside quotes,
+// but a double quote inside the value ends the quoted part, so they are escaped with ^ until the next one.
+func escapeBatch(value string) string {
+	var escaped strings.Builder
+	quoted := true
+	for _, c := range value {
+		switch {
+		case c == '%':
+			escaped.WriteString("%%")
+			continue
+		case c == '"':
+			quoted = !quoted
+		case !quoted && strings.ContainsRune("^&|<>()", c):
+			escaped.WriteRune('^')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,128 @@
+package nrbuildpack
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Script", func() {
+	// values that break unquoted scripts or get expanded by the shell
+	difficultValues := map[string]string{
+		"NEW_RELIC_APP_NAME":       "My App (staging); My App Rollup",
+		"NEW_RELIC_LABELS":         "team:a&b;env:$ENV|`whoami`",
+		"NEW_RELIC_PROXY_PASSWORD": `p@ss'wo"rd%PATH%^!<>`,
+		"NEW_RELIC_HOST":           "",
+		"NEWRELIC_LOG_LEVEL":       "debug",
+		"NEW_RELIC_QUOTES":         `say "a&b" then c&d`,
+	}
+
+	golden := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		Expect(err).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	Context("PosixShell", func() {
+		It("renders profiler paths and quoted values in name order", func() {
+			script := NewScript(PosixShell)
+			script.SetEnvPath("CORECLR_NEWRELIC_HOME", "DEPS_DIR", "/0/newrelic-dotnet-agent")
+			script.SetEnv("CORECLR_ENABLE_PROFILING", "1")
+			script.SetEnvs(difficultValues)
+
+			content, err := script.Render()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(content).To(Equal(golden("newrelic.sh.golden")))
+		})
+
+		It("skips a block when the env var is set to the value", func() {
+			script := NewScript(PosixShell)
+			script.SkipIf("NEW_RELIC_AGENT_ENABLED", "false")
+			script.SetEnv("CORECLR_ENABLE_PROFILING", "1")
+			script.EndSkip()
+
+			content, err := script.Render()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(content).To(Equal("if [ \"$(printf '%s' \"${NEW_RELIC_AGENT_ENABLED:-}\" | tr '[:upper:]' '[:lower:]')\" != 'false' ]; then\n" +
+				"  export CORECLR_ENABLE_PROFILING='1'\n" +
+				"fi\n"))
+		})
+
+		It("keeps line breaks in values", func() {
+			script := NewScript(PosixShell)
+			script.SetEnv("NEW_RELIC_LABELS", "a\nb")
+
+			content, err := script.Render()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(content).To(Equal("export NEW_RELIC_LABELS='a\nb'\n"))
+		})
+	})
+
+	Context("WindowsBatch", func() {
+		It("renders profiler paths and escaped values in name order", func() {
+			script := NewScript(WindowsBatch)
+			script.SetEnvPath("NEWRELIC_HOME", "~dp0", "newrelic")
+			script.SetEnvPath("COR_PROFILER_PATH", "DEPS_DIR", `\0\newrelic\NewRelic.Profiler.dll`)
+			script.SetEnvs(difficultValues)
+			script.Command(`.cloudfoundry\hwc.exe`)
+
+			content, err := script.Render()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(content).To(Equal(golden("run.cmd.golden")))
+		})
+
+		It("skips a block when the env var is set to the value", func() {
+			script := NewScript(WindowsBatch)
+			script.SkipIf("NEW_RELIC_AGENT_ENABLED", "false")
+			script.SetEnv("COR_ENABLE_PROFILING", "1")
+			script.EndSkip()
+			script.Command(`.cloudfoundry\hwc.exe`)
+
+			content, err := script.Render()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(content).To(Equal("if /i \"%NEW_RELIC_AGENT_ENABLED%\"==\"false\" goto :skip_NEW_RELIC_AGENT_ENABLED\r\n" +
+				"set \"COR_ENABLE_PROFILING=1\"\r\n" +
+				":skip_NEW_RELIC_AGENT_ENABLED\r\n" +
+				".cloudfoundry\\hwc.exe\r\n"))
+		})
+
+		It("rejects values with line breaks", func() {
+			script := NewScript(WindowsBatch)
+			script.SetEnv("NEW_RELIC_LABELS", "a\r\nb")
+
+			_, err := script.Render()
+			Expect(err).To(MatchError(ContainSubstring("NEW_RELIC_LABELS")))
+		})
+	})
+
+	It("rejects invalid env var names", func() {
+		script := NewScript(PosixShell)
+		script.SetEnv("LD_PRELOAD=/tmp/x.so; echo", "1")
+
+		_, err := script.Render()
+		Expect(err).To(MatchError(ContainSubstring("invalid env var name")))
+	})
+
+	It("rejects unterminated skip blocks", func() {
+		script := NewScript(PosixShell)
+		script.SkipIf("NEW_RELIC_AGENT_ENABLED", "false")
+
+		_, err := script.Render()
+		Expect(err).To(MatchError(ContainSubstring("without EndSkip")))
+	})
+
+	It("renders the same script for every run", func() {
+		render := func() string {
+			script := NewScript(PosixShell)
+			script.SetEnvs(difficultValues)
+			content, _ := script.Render()
+			return content
+		}
+		first := render()
+		for i := 0; i < 10; i++ {
+			Expect(render()).To(Equal(first))
+		}
+	})
+})
@@ -0,0 +1,512 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// Simulation stages a copy of an app offline, with the real supply logic and an agent archive
+// of the local disk, so bindings and config changes can be checked before pushing the app
+type Simulation struct {
+	AppDir       string
+	BuildpackDir string            // folder with manifest.yml, newrelic.config and credentials.yml of the buildpack
+	Env          map[string]string // VCAP_SERVICES, VCAP_APPLICATION and the env overrides of the app
+	AgentArchive string            // served for every agent download
+	AgentVersion string            // version of the archive, defaults to the version in its file name
+	LaunchHelper string            // defaults to the launch helper next to the executable, or a placeholder
+	Platform     Platform
+	Log          *libbuildpack.Logger
+	Redactor     *Redactor
+}
+
+// SnapshotSection is a file staged in the droplet, or the agent layout or launch env
+type SnapshotSection struct {
+	Name    string
+	Content string
+}
+
+// Snapshot is the outcome of a simulation, with the staging folders replaced by
+// $BUILD_DIR, $DEPS_DIR and $CACHE_DIR so snapshots of different runs compare
+type Snapshot []SnapshotSection
+
+func (snapshot Snapshot) String() string {
+	var out bytes.Buffer
+	for _, section := range snapshot {
+		out.WriteString("== " + section.Name + "\n")
+		out.WriteString(section.Content)
+		if section.Content != "" && !strings.HasSuffix(section.Content, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+// simulation output that changes with every run, left out of snapshots
+var unstableSimulationFiles = map[string]bool{
+	stagingReportFileName:                   true,
+	sbomComponentName + "." + sbomCycloneDX: true,
+	sbomComponentName + "." + sbomSPDX:      true,
+}
+
+// Run stages the app in temporary folders and returns the snapshot of the droplet
+func (sim *Simulation) Run() (Snapshot, error) {
+	root, err := ioutil.TempDir("", "newrelic-simulation")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+
+	stager := &simulationStager{
+		buildDir: filepath.Join(root, "app"),
+		depsDir:  filepath.Join(root, "deps"),
+		cacheDir: filepath.Join(root, "cache"),
+	}
+	for _, dir := range []string{stager.buildDir, stager.DepDir(), stager.cacheDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	// the hwc extension writes newrelic-run.cmd and the Procfile in the app folder in start wrapper mode
+	if err := libbuildpack.CopyDirectory(sim.AppDir, stager.buildDir); err != nil {
+		return nil, err
+	}
+
+	client, err := newOfflineHTTPClient(sim.Log, sim.AgentArchive, sim.AgentVersion)
+	if err != nil {
+		return nil, err
+	}
+	launchHelper, err := sim.launchHelper(root)
+	if err != nil {
+		return nil, err
+	}
+	env := simulationEnvironment{"BUILDPACK_DIR": sim.BuildpackDir}
+	for name, value := range sim.Env {
+		env[name] = value
+	}
+
+	s := &Supplier{
+		Stager:       stager,
+		Log:          sim.Log,
+		Redactor:     sim.Redactor,
+		Platform:     sim.Platform,
+		Env:          env,
+		HTTPClient:   client,
+		LaunchHelper: launchHelper,
+	}
+	if exists, _ := libbuildpack.FileExists(filepath.Join(sim.BuildpackDir, "manifest.yml")); exists {
+		manifest, err := libbuildpack.NewManifest(sim.BuildpackDir, sim.Log, s.now())
+		if err != nil {
+			return nil, err
+		}
+		s.Manifest = manifest
+	}
+	if err := s.Run(); err != nil {
+		return nil, err
+	}
+
+	var launch map[string]string
+	agentHome := s.Report().Agent.Home
+	if agentHome != "" {
+		// what the launch helper adds when the app starts, it also writes the mapped settings to newrelic.config
+		settings, err := resolveLaunch(s, filepath.Join(agentHome, launchMappingFileName), filepath.Join(agentHome, "newrelic.config"))
+		if err != nil {
+			return nil, err
+		}
+		launch = settings.Env
+	}
+	snapshot, err := simulationSnapshot(sim.AppDir, stager, agentHome, launch)
+	if err != nil {
+		return nil, err
+	}
+	folders := strings.NewReplacer(stager.buildDir, "$BUILD_DIR", stager.depsDir, "$DEPS_DIR", stager.cacheDir, "$CACHE_DIR")
+	for i := range snapshot {
+		snapshot[i].Name = folders.Replace(snapshot[i].Name)
+		snapshot[i].Content = sim.Redactor.Redact(folders.Replace(snapshot[i].Content))
+	}
+	return snapshot, nil
+}
+
+// launchHelper returns the launch helper to install, a placeholder if it is not built
+func (sim *Simulation) launchHelper(root string) (string, error) {
+	executable := launchHelperExecutable(sim.Platform.Dialect())
+	if sim.LaunchHelper != "" {
+		return sim.LaunchHelper, nil
+	}
+	if self, err := os.Executable(); err == nil {
+		launchHelper := filepath.Join(filepath.Dir(self), executable)
+		if exists, _ := libbuildpack.FileExists(launchHelper); exists {
+			return launchHelper, nil
+		}
+	}
+	placeholder := filepath.Join(root, executable)
+	return placeholder, ioutil.WriteFile(placeholder, []byte("placeholder of the launch helper\n"), 0755)
+}
+
+// simulationSnapshot collects the files written to deps/IDX, the files added to or changed in the app,
+// the layout of the agent, its newrelic.config and the env of the launch helper
+func simulationSnapshot(appDir string, stager *simulationStager, agentHome string, launch map[string]string) (Snapshot, error) {
+	var snapshot Snapshot
+
+	depFiles, err := snapshotFiles(stager.DepDir(), agentHome, func(name string) bool {
+		return !unstableSimulationFiles[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range depFiles {
+		content, err := ioutil.ReadFile(filepath.Join(stager.DepDir(), name))
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, SnapshotSection{Name: filepath.ToSlash(filepath.Join("$DEPS_DIR", stager.DepsIdx(), name)), Content: string(content)})
+	}
+
+	appFiles, err := snapshotFiles(stager.buildDir, agentHome, func(name string) bool {
+		original, err := ioutil.ReadFile(filepath.Join(appDir, name))
+		if err != nil {
+			return true // added by the extension
+		}
+		staged, err := ioutil.ReadFile(filepath.Join(stager.buildDir, name))
+		return err != nil || !bytes.Equal(original, staged)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range appFiles {
+		content, err := ioutil.ReadFile(filepath.Join(stager.buildDir, name))
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, SnapshotSection{Name: filepath.ToSlash(filepath.Join("$BUILD_DIR", name)), Content: string(content)})
+	}
+
+	if agentHome == "" {
+		return append(snapshot, SnapshotSection{Name: "agent", Content: "not installed\n"}), nil
+	}
+	layout, err := snapshotFiles(agentHome, "", func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	snapshot = append(snapshot, SnapshotSection{Name: "agent " + agentHome, Content: strings.Join(slashPaths(layout), "\n")})
+
+	config, err := ioutil.ReadFile(filepath.Join(agentHome, "newrelic.config"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	snapshot = append(snapshot, SnapshotSection{Name: "agent newrelic.config", Content: string(config)})
+
+	var env []string
+	for _, name := range sortedKeys(launch) {
+		env = append(env, name+"="+launch[name])
+	}
+	return append(snapshot, SnapshotSection{Name: "launch env", Content: strings.Join(env, "\n")}), nil
+}
+
+// snapshotFiles returns the files of a folder relative to it in name order, except those of skipDir
+func snapshotFiles(dir string, skipDir string, include func(name string) bool) ([]string, error) {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == skipDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if include(name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func slashPaths(paths []string) []string {
+	slashed := make([]string, len(paths))
+	for i, path := range paths {
+		slashed[i] = filepath.ToSlash(path)
+	}
+	return slashed
+}
+
+// DiffSnapshots compares the rendered snapshots line by line, and returns the removed lines
+// prefixed with "-" and the added ones with "+", under the "==" line of their section.
+// It returns "" if they are the same.
+func DiffSnapshots(previous string, current string) string {
+	if previous == current {
+		return ""
+	}
+	a := strings.Split(strings.TrimSuffix(previous, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(current, "\n"), "\n")
+
+	// longest common subsequence of the lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	section, printed := "", ""
+	change := func(line string) {
+		if strings.HasPrefix(line[1:], "== ") {
+			// lines of an added or removed section follow their own "==" line
+			section, printed = line[1:], line[1:]
+		} else if section != printed {
+			out.WriteString(section + "\n")
+			printed = section
+		}
+		out.WriteString(line + "\n")
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			if strings.HasPrefix(a[i], "== ") {
+				section = a[i]
+			}
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			change("-" + a[i])
+			i++
+		default:
+			change("+" + b[j])
+			j++
+		}
+	}
+	return out.String()
+}
+
+// simulationStager stages in temporary folders like libbuildpack.Stager
+type simulationStager struct {
+	buildDir string
+	depsDir  string
+	cacheDir string
+}
+
+func (s *simulationStager) BuildDir() string { return s.buildDir }
+func (s *simulationStager) DepDir() string   { return filepath.Join(s.depsDir, s.DepsIdx()) }
+func (s *simulationStager) DepsIdx() string  { return "0" }
+func (s *simulationStager) DepsDir() string  { return s.depsDir }
+func (s *simulationStager) CacheDir() string { return s.cacheDir }
+
+func (s *simulationStager) WriteProfileD(scriptName string, scriptContents string) error {
+	return writeToFile(strings.NewReader(scriptContents), filepath.Join(s.DepDir(), "profile.d", scriptName), 0755)
+}
+
+func (s *simulationStager) WriteEnvFile(envVar string, envVal string) error {
+	return writeToFile(strings.NewReader(envVal), filepath.Join(s.DepDir(), "env", envVar), 0644)
+}
+
+// simulationEnvironment is the environment of the simulated app, the process environment is not used
+type simulationEnvironment map[string]string
+
+func (e simulationEnvironment) LookupEnv(name string) (string, bool) {
+	value, ok := e[name]
+	return value, ok
+}
+
+func (e simulationEnvironment) Environ() []string {
+	environ := make([]string, 0, len(e))
+	for name, value := range e {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+// offlineHTTPClient answers the requests of supply without network: the metadata bucket lists
+// the version of the local archive, SHA256 files have its checksum, and any other url is the archive
+type offlineHTTPClient struct {
+	log     *libbuildpack.Logger
+	archive string
+	version string
+	sha256  string
+}
+
+func newOfflineHTTPClient(log *libbuildpack.Logger, archive string, version string) (*offlineHTTPClient, error) {
+	sum, err := fileSha256(archive)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		version = versionFromURL(filepath.Base(archive))
+	}
+	return &offlineHTTPClient{log: log, archive: archive, version: version, sha256: sum}, nil
+}
+
+func (c *offlineHTTPClient) Get(url string) (*http.Response, error) {
+	switch {
+	case url == bucketXMLUrl:
+		if c.version == "" {
+			return nil, errors.New("the version of " + c.archive + " is unknown, it is needed for the latest agent")
+		}
+		c.log.Debug("Simulating the metadata bucket with agent %s", c.version)
+		return offlineResponse("<ListBucketResult><Contents><Key>dot_net_agent/latest_release/newrelic-dotnet-agent_" +
+			c.version + "_amd64.tar.gz</Key></Contents></ListBucketResult>"), nil
+	case strings.HasSuffix(url, ".sha256"):
+		c.log.Debug("Simulating %s with the checksum of %s", url, c.archive)
+		return offlineResponse(c.sha256 + "  " + filepath.Base(c.archive) + "\n"), nil
+	}
+	content, err := ioutil.ReadFile(c.archive)
+	if err != nil {
+		return nil, err
+	}
+	c.log.Info("Simulating the download of %s with %s", url, c.archive)
+	return offlineResponse(string(content)), nil
+}
+
+func offlineResponse(body string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// EnvFlag collects the NAME=VALUE arguments of a repeated flag
+type EnvFlag map[string]string
+
+func (f EnvFlag) String() string {
+	return strings.Join(simulationEnvironment(f).Environ(), " ")
+}
+
+func (f EnvFlag) Set(assignment string) error {
+	parts := strings.SplitN(assignment, "=", 2)
+	if len(parts) != 2 || !scriptEnvVarNamePattern.MatchString(parts[0]) {
+		return errors.New("\"" + assignment + "\" is not NAME=VALUE")
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+// SimulateMain is the newrelic-simulate command of the extensions: it stages an app locally with the supply
+// logic of the platform and a local agent archive, and prints a snapshot of the staged droplet.
+// With -diff it compares the snapshot to one saved with -out instead.
+func SimulateMain(platform Platform) {
+	env := EnvFlag{}
+	appDir := flag.String("app", "", "app folder to stage")
+	agentArchive := flag.String("agent", "", "agent archive served for every agent download")
+	agentVersion := flag.String("agent-version", "", "version of the agent archive, defaults to the version in its file name")
+	buildpackDir := flag.String("buildpack", "", "buildpack folder with manifest.yml, newrelic.config and credentials.yml")
+	vcapServices := flag.String("vcap-services", "", "JSON file with the VCAP_SERVICES of the app")
+	vcapApplication := flag.String("vcap-application", "", "JSON file with the VCAP_APPLICATION of the app")
+	launchHelper := flag.String("launch-helper", "", "launch helper to install, defaults to newrelic-launch next to this program")
+	out := flag.String("out", "", "write the snapshot to this file")
+	diff := flag.String("diff", "", "compare the snapshot to this file, exits with 1 if they differ")
+	flag.Var(env, "env", "NAME=VALUE env var of the app, repeatable")
+	flag.Parse()
+
+	// stdout is the snapshot, the staging output goes to stderr
+	redactor := NewRedactor(os.Stderr)
+	logger := libbuildpack.NewLogger(redactor)
+
+	if *appDir == "" || *agentArchive == "" {
+		fmt.Fprintln(os.Stderr, "usage: newrelic-simulate -app DIR -agent ARCHIVE [options]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if *buildpackDir == "" {
+		dir, err := libbuildpack.GetBuildpackDir()
+		if err != nil {
+			logger.Error("Unable to determine buildpack directory: %s", err.Error())
+			os.Exit(2)
+		}
+		*buildpackDir = dir
+	}
+	for name, file := range map[string]string{"VCAP_SERVICES": *vcapServices, "VCAP_APPLICATION": *vcapApplication} {
+		if _, set := env[name]; set || file == "" {
+			continue
+		}
+		content, err := readJSONFile(file)
+		if err != nil {
+			logger.Error("Unable to read %s: %s", name, err.Error())
+			os.Exit(2)
+		}
+		env[name] = content
+	}
+	if _, set := env["VCAP_APPLICATION"]; !set {
+		env["VCAP_APPLICATION"] = "{}"
+	}
+
+	simulation := &Simulation{
+		AppDir:       *appDir,
+		BuildpackDir: *buildpackDir,
+		Env:          env,
+		AgentArchive: *agentArchive,
+		AgentVersion: *agentVersion,
+		LaunchHelper: *launchHelper,
+		Platform:     platform,
+		Log:          logger,
+		Redactor:     redactor,
+	}
+	snapshot, err := simulation.Run()
+	if err != nil {
+		logger.Error("Simulated staging failed: %s", err.Error())
+		os.Exit(1)
+	}
+
+	if *out != "" {
+		if err := ioutil.WriteFile(*out, []byte(snapshot.String()), 0644); err != nil {
+			logger.Error("Unable to write the snapshot: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *diff == "" {
+		if *out == "" {
+			fmt.Print(snapshot.String())
+		}
+		return
+	}
+	previous, err := ioutil.ReadFile(*diff)
+	if err != nil {
+		logger.Error("Unable to read the snapshot: %s", err.Error())
+		os.Exit(1)
+	}
+	if changes := DiffSnapshots(string(previous), snapshot.String()); changes != "" {
+		fmt.Print(changes)
+		os.Exit(1)
+	}
+}
+
+// readJSONFile returns the content of a JSON file, after checking it is valid JSON
+func readJSONFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
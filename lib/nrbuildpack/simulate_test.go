@@ -0,0 +1,121 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Simulation", func() {
+	const licenseKey = "0123456789abcdef0123456789abcdef01234567"
+
+	var (
+		root       string
+		buffer     *bytes.Buffer
+		simulation *Simulation
+	)
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "nrbuildpack-simulation")
+		Expect(err).NotTo(HaveOccurred())
+
+		writeFile(filepath.Join(root, "app", "app.dll"), "app")
+		writeFile(filepath.Join(root, "buildpack", "manifest.yml"),
+			"---\nlanguage: fake\ndependencies:\n- name: newrelic\n  version: latest\n  uri: "+fakeAgentURL+"\n")
+		archive := filepath.Join(root, "newrelic-dotnet-agent_10.20.1_amd64.tar.gz")
+		writeFile(archive, string(agentArchive("newrelic-dotnet-agent", map[string]string{
+			"libNewRelicProfiler.so": "profiler",
+			"newrelic.config":        `<configuration xmlns="urn:newrelic-config"><service licenseKey="REPLACE" /></configuration>`,
+		})))
+
+		buffer = new(bytes.Buffer)
+		redactor := NewRedactor(buffer)
+		simulation = &Simulation{
+			AppDir:       filepath.Join(root, "app"),
+			BuildpackDir: filepath.Join(root, "buildpack"),
+			Env: map[string]string{
+				"VCAP_APPLICATION": `{"application_name":"vcap-app"}`,
+				"VCAP_SERVICES":    `{"user-provided":[{"name":"newrelic","credentials":{"license_key":"` + licenseKey + `"}}]}`,
+			},
+			AgentArchive: archive,
+			Platform:     &fakePlatform{},
+			Log:          libbuildpack.NewLogger(redactor),
+			Redactor:     redactor,
+		}
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("stages a copy of the app with the local agent archive", func() {
+		snapshot, err := simulation.Run()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(snapshot.String()).To(ContainSubstring("== $DEPS_DIR/0/profile.d/newrelic.sh\n"))
+		Expect(snapshot.String()).To(ContainSubstring(`export CORECLR_NEWRELIC_HOME="${DEPS_DIR}/0/newrelic-dotnet-agent"`))
+		Expect(snapshot.String()).To(ContainSubstring("== $DEPS_DIR/0/env/NEW_RELIC_BUILDPACK_AGENT_VERSION\n10.20.1\n"))
+		Expect(snapshot.String()).To(ContainSubstring("== agent $DEPS_DIR/0/newrelic-dotnet-agent\n" +
+			"credentials.yml\nlibNewRelicProfiler.so\nnewrelic-launch\nnewrelic.config\n"))
+		Expect(snapshot.String()).To(ContainSubstring("== launch env\nNEW_RELIC_APP_NAME=vcap-app\nNEW_RELIC_LICENSE_KEY=**redacted**\n"))
+		Expect(snapshot.String()).NotTo(ContainSubstring(stagingReportFileName))
+		Expect(snapshot.String()).NotTo(ContainSubstring(licenseKey))
+		Expect(snapshot.String()).NotTo(ContainSubstring(os.TempDir()))
+
+		files, err := ioutil.ReadDir(simulation.AppDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("snapshots the same staging the same way", func() {
+		first, err := simulation.Run()
+		Expect(err).NotTo(HaveOccurred())
+		second, err := simulation.Run()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(DiffSnapshots(first.String(), second.String())).To(BeEmpty())
+	})
+
+	It("installs nothing in a dry run", func() {
+		simulation.Env["NEW_RELIC_BUILDPACK_DRY_RUN"] = "true"
+		writeFile(filepath.Join(root, "app", "newrelic.config"), "<configuration/>")
+
+		snapshot, err := simulation.Run()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(snapshot.String()).To(Equal("== agent\nnot installed\n"))
+		Expect(buffer.String()).To(ContainSubstring("|-- newrelic.config: app\n"))
+	})
+
+	Describe("DiffSnapshots", func() {
+		It("lists the changed lines under their section", func() {
+			previous := "== profile.d\nexport A=1\nexport B=2\n== agent\nlib.so\n"
+			current := "== profile.d\nexport A=1\nexport B=3\n== agent\nlib.so\n== launch env\nNEW_RELIC_APP_NAME=app\n"
+
+			Expect(DiffSnapshots(previous, current)).To(Equal("== profile.d\n-export B=2\n+export B=3\n" +
+				"+== launch env\n+NEW_RELIC_APP_NAME=app\n"))
+		})
+	})
+
+	Describe("EnvFlag", func() {
+		It("collects NAME=VALUE assignments", func() {
+			env := EnvFlag{}
+			Expect(env.Set("NEW_RELIC_APP_NAME=my=app")).To(Succeed())
+			Expect(env.Set("NEW_RELIC_APP_NAME")).To(MatchError(`"NEW_RELIC_APP_NAME" is not NAME=VALUE`))
+			Expect(env.Set("1A=b")).NotTo(Succeed())
+
+			Expect(env).To(Equal(EnvFlag{"NEW_RELIC_APP_NAME": "my=app"}))
+		})
+	})
+})
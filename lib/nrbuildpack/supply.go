@@ -0,0 +1,1125 @@
+package nrbuildpack
+
+import (
+	"encoding/xml"
+	// "crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+type Stager interface {
+	//TODO: See more options at https://github.com/cloudfoundry/libbuildpack/blob/master/stager.go
+	BuildDir() string
+	DepDir() string
+	DepsIdx() string
+	DepsDir() string
+	CacheDir() string
+	WriteProfileD(string, string) error
+	/* unused calls
+	CacheDir() string
+	LinkDirectoryInDepDir(string, string) error
+	//AddBinDependencyLink(string, string) error
+	WriteEnvFile(string, string) error
+	WriteProfileD(string, string) error
+	SetStagingEnvironment() error
+	*/
+}
+
+type Manifest interface {
+	//TODO: See more options at https://github.com/cloudfoundry/libbuildpack/blob/master/manifest.go
+	AllDependencyVersions(string) []string
+	DefaultVersion(string) (libbuildpack.Dependency, error)
+}
+
+type Installer interface {
+	//TODO: See more options at https://github.com/cloudfoundry/libbuildpack/blob/master/installer.go
+	InstallDependency(libbuildpack.Dependency, string) error
+	InstallOnlyVersion(string, string) error
+	/* unused calls
+	FetchDependency(libbuildpack.Dependency, string) error
+	*/
+}
+
+type Command interface {
+	//TODO: See more options at https://github.com/cloudfoundry/libbuildpack/blob/master/command.go
+	Execute(string, io.Writer, io.Writer, string, ...string) error
+	Output(dir string, program string, args ...string) (string, error)
+	/* unused calls
+	Output(string, string, ...string) (string, error)
+	*/
+}
+
+// Environment is the process environment, so staging can run with any set of env vars
+type Environment interface {
+	LookupEnv(string) (string, bool)
+	Environ() []string
+}
+
+type osEnvironment struct{}
+
+func (osEnvironment) LookupEnv(name string) (string, bool) { return os.LookupEnv(name) }
+func (osEnvironment) Environ() []string                    { return os.Environ() }
+
+// AgentSource is the agent to install and where it comes from, see resolveAgentSource
+type AgentSource struct {
+	Method    string // one of the Agent* methods
+	URL       string // download url, set unless the agent is cached in the buildpack
+	File      string // agent archive cached in the buildpack
+	Version   string // agent version, "" if it can't be told from the url
+	SHA256    string // expected checksum of the archive, "" if unknown
+	NewLayout bool   // agent 10.0 and later changed the folder structure
+}
+
+// methods to obtain the agent, in order of precedence
+const (
+	AgentFromDownloadURL    = "download_url"    // NEW_RELIC_DOWNLOAD_URL
+	AgentFromBuildpackCache = "buildpack_cache" // cached buildpack
+	AgentFromVersionEnv     = "version_env"     // NEW_RELIC_AGENT_VERSION
+	AgentLatest             = "latest"          // latest version from the metadata bucket
+	AgentFromManifest       = "manifest"        // version and url from the buildpack's manifest
+)
+
+type HTTPClient interface {
+	Get(url string) (*http.Response, error)
+}
+
+type Supplier struct {
+	Manifest     Manifest
+	Installer    Installer
+	Stager       Stager
+	Command      Command
+	Log          *libbuildpack.Logger
+	Redactor     *Redactor        // masks secrets in the output of Log
+	Platform     Platform         // core or hwc specifics
+	Env          Environment      // defaults to the environment of the process
+	HTTPClient   HTTPClient       // defaults to an http.Client with a 10 second timeout
+	Now          func() time.Time // defaults to time.Now
+	LaunchHelper string           // defaults to the launch helper next to the supply executable
+
+	// state of a single Run, reset when it starts
+	buildpackDir       string
+	agentSource        *AgentSource
+	installedAgent     *InstalledAgent
+	report             *StagingReport
+	archiveSha256      string              // of the installed archive, "" if the agent was reused
+	envVars            map[string]string   // agent env vars resolved from the environment
+	configSettings     map[string]string   // newrelic.config settings resolved from service credentials, keyed by config path
+	settingOrigins     map[string]string   // what set each of envVars and configSettings, explained by the dry run
+	credentialMappings *credentialMappings // nil until loaded, the built-in mappings are used then
+	jsonLog            *jsonLogWriter      // set while Run writes JSON events, see NEW_RELIC_BUILDPACK_LOG_FORMAT
+	/* unused calls
+	Config    *config.Config
+	Project   *project.Project
+	*/
+}
+
+// for latest_release only - get latest version of the agent
+const bucketXMLUrl = "https://nr-downloads-main.s3.amazonaws.com/?delimiter=/&prefix=dot_net_agent/latest_release/"
+
+// regexp patterns to find agent version from urls
+const nrVersionPattern = "((\\d{1,3}\\.){2}\\d{1,3})"
+const preOpenSourceNrVersionPattern = "((\\d{1,3}\\.){3}\\d{1,3})"
+
+type bucketResultXMLNode struct {
+	XMLName xml.Name
+	Content []byte                `xml:",innerxml"`
+	Nodes   []bucketResultXMLNode `xml:",any"`
+}
+
+// "cf set-env APP NEW_RELIC_AGENT_ENABLED false" and a restart disable the profiler without restaging.
+// With NEW_RELIC_SKIP_INSTALL_WHEN_DISABLED=true the agent isn't even installed during staging.
+const agentEnabledEnvVar = "NEW_RELIC_AGENT_ENABLED"
+const skipInstallWhenDisabledEnvVar = "NEW_RELIC_SKIP_INSTALL_WHEN_DISABLED"
+
+// RULES for installing newrelic agent:
+//	if:
+//		- NEW_RELIC_LICENSE_KEY exists
+//		- NEW_RELIC_DOWNLOAD_URL exists
+//		- there is a user-provided-service with the word "newrelic" in the name
+//		- there is a SERVICE in VCAP_SERVICES (or VCAP_SERVICES_FILE_PATH) with the name "newrelic"
+//		- for cached buildpack: nrDownloadFile from manifest is set to file name (non-blank)
+//	then execute Run()
+
+func (s *Supplier) Run() error {
+	s.buildpackDir = ""
+	s.agentSource = nil
+	s.installedAgent = nil
+	s.archiveSha256 = ""
+	s.envVars = nil
+	s.configSettings = nil
+	s.settingOrigins = nil
+	s.credentialMappings = nil
+	start := s.now()
+	s.report = &StagingReport{Extension: s.Platform.ExtensionName(), StagedAt: start.UTC(), Warnings: []string{}, Steps: []ReportStep{}}
+
+	s.Redactor.AddSecretsFromEnv(s.env().Environ())
+	if jsonLogFormat(s) {
+		defer useJSONLog(s)()
+	}
+
+	s.Log.BeginStep("Supplying Newrelic %s Extension", s.Platform.ExtensionName())
+
+	s.Log.Debug("  >>>>>>> BuildDir: %s", s.Stager.BuildDir())
+	s.Log.Debug("  >>>>>>> DepDir  : %s", s.Stager.DepDir())
+	s.Log.Debug("  >>>>>>> DepsIdx : %s", s.Stager.DepsIdx())
+	s.Log.Debug("  >>>>>>> DepsDir : %s", s.Stager.DepsDir())
+	s.Log.Debug("  >>>>>>> CacheDir: %s", s.Stager.CacheDir())
+
+	if dryRun(s) {
+		return explainStaging(s)
+	}
+
+	if NrServiceExists := detectNewRelicService(s); !NrServiceExists {
+		s.Log.Info("No New Relic service to bind to...")
+		return nil
+	}
+
+	if agentDisabled(s) {
+		if strings.EqualFold(strings.TrimSpace(s.getenv(skipInstallWhenDisabledEnvVar)), "true") {
+			s.Log.Info("New Relic agent is disabled by %s, skipping agent installation", agentEnabledEnvVar)
+			return nil
+		}
+		s.Log.Info("New Relic agent is disabled by %s, the profiler is not enabled until it is unset and the app is restarted", agentEnabledEnvVar)
+	}
+
+	s.Log.BeginStep("Installing NewRelic %s Agent", s.Platform.AgentName())
+
+	buildpackDir, err := getBuildpackDir(s)
+	if err != nil {
+		s.Log.Error("Unable to install New Relic: %s", err.Error())
+		return err
+	}
+	s.buildpackDir = buildpackDir
+	s.Log.Debug("buildpackDir: %v", buildpackDir)
+
+	if err := loadCredentialMappings(s, buildpackDir); err != nil {
+		s.Log.Error("Unable to load credentials mapping: %s", err.Error())
+		return err
+	}
+
+	s.Log.BeginStep("Creating cache directory %s", s.Stager.CacheDir())
+	if err := os.MkdirAll(s.Stager.CacheDir(), 0755); err != nil {
+		s.Log.Error("Failed to create cache directory %s: %s", s.Stager.CacheDir(), err.Error())
+		return err
+	}
+
+	// set temp directory for downloads
+	s.Log.Debug("Creating tmp folder for downloading agent")
+	tmpDir, err := ioutil.TempDir(s.Stager.DepDir(), "downloads")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir) // the archive isn't needed once it is extracted
+
+	var source AgentSource
+	err = s.step("resolve agent", func() error {
+		source, err = resolveAgentSource(s, buildpackDir, tmpDir)
+		if err != nil {
+			return err
+		}
+		return checkRuntimeCompatibility(s, source)
+	})
+	if err != nil {
+		return err
+	}
+	s.agentSource = &source
+
+	nrAgentPath := ""
+	err = s.step("install agent", func() error {
+		// a platform keeping agents between builds may already have this one
+		reused := false
+		if cache, ok := s.Platform.(AgentCache); ok {
+			nrAgentPath, reused = cache.CachedAgent(s, source)
+		}
+		if reused {
+			s.Log.Info("Reusing New Relic agent %s", source.Version)
+		} else if nrAgentPath, err = installAgent(s, source, filepath.Join(tmpDir, s.Platform.ArchiveFileName())); err != nil {
+			return err
+		}
+		reportAgent(s, source, nrAgentPath, reused)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Log.Debug("New Relic Agent Path: %s", nrAgentPath)
+
+	err = s.step("configure agent", func() error {
+		// decide which newrelic.config file to use (appdir, buildpackdir, agentdir)
+		if err := getNewRelicConfigFile(s, nrAgentPath, buildpackDir); err != nil {
+			return err
+		}
+
+		// if there is newrelic_instrumentation.xml file in app folder, copy it to agent's "extensions" directory
+		if err := getNewRelicXmlInstrumentationFile(s, nrAgentPath); err != nil {
+			return err
+		}
+
+		if configurer, ok := s.Platform.(AgentConfigurer); ok {
+			if err := configurer.ConfigureAgent(s, nrAgentPath); err != nil {
+				return err
+			}
+		}
+
+		// credentials are resolved by the launch helper when the container starts
+		if err := installLaunchHelper(s, nrAgentPath); err != nil {
+			s.Log.Error("Unable to install New Relic launch helper: %s", err.Error())
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// build the script enabling the profiler (profile.d or newrelic-run.cmd)
+	if err := s.step("enable profiler", func() error { return buildProfileD(s, nrAgentPath) }); err != nil {
+		return err
+	}
+
+	// describe the agent for the compliance scanners of the droplet
+	err = s.step("write sbom", func() error {
+		s.report.SBOM, err = writeSBOM(s, nrAgentPath)
+		return err
+	})
+	if err != nil {
+		s.Log.Error("Unable to write the New Relic agent SBOM: %s", err.Error())
+		return err
+	}
+
+	s.Log.Info("Installing New Relic Agent Completed.")
+	duration := s.now().Sub(start)
+	s.Log.Debug("New Relic agent installed in %s", duration)
+	s.report.DurationMs = milliseconds(duration)
+	return writeStagingReport(s)
+}
+
+// resolveAgentSource decides which agent to install and where it comes from, without downloading it.
+// Resolving the latest version reads the metadata bucket and the SHA256 file of the agent.
+func resolveAgentSource(s *Supplier, buildpackDir string, tmpDir string) (AgentSource, error) {
+	// previous_releases contains all releases including latest
+	nrAgentDownloadUrl, latestNrDownloadSha256Url := s.Platform.AgentURLs(false)
+	versionPattern := nrVersionPattern
+	newAgentLayout := false // agent 10.0 and later changed the folder structure
+
+	nrDownloadURL := nrAgentDownloadUrl
+	nrDownloadFile := ""
+	nrVersion := "latest"
+	nrSha256Sum := ""
+
+	// #################################################################
+	// determine the method to obtain the agent ########################
+	nrav, isAgenVersionEnvSet := s.env().LookupEnv("NEW_RELIC_AGENT_VERSION")
+	downloadURL, isAgentUrlEnvSet := s.env().LookupEnv("NEW_RELIC_DOWNLOAD_URL")
+	cachedBuildpack := false
+	if isAgenVersionEnvSet && isAgentUrlEnvSet {
+		s.warn("\nboth NEW_RELIC_AGENT_VERSION and NEW_RELIC_DOWNLOAD_URL are specified. Ignoring NEW_RELIC_AGENT_VERSION and using NEW_RELIC_DOWNLOAD_URL")
+		nrav = ""
+	}
+	//////////////////////////////////////////////////////////////////////
+	var manifestEntries []libbuildpack.ManifestEntry
+	if manifest, ok := s.Manifest.(*libbuildpack.Manifest); ok {
+		manifestEntries = manifest.ManifestEntries
+	}
+	for _, entry := range manifestEntries {
+		if entry.Dependency.Name == "newrelic" {
+			nrDownloadURL = entry.URI
+			nrVersion = entry.Dependency.Version
+			nrDownloadFile = entry.File
+			nrSha256Sum = entry.SHA256
+			if nrDownloadFile != "" {
+				cachedBuildpack = true
+			}
+			break
+		}
+	}
+
+	if isAgenVersionEnvSet {
+		if cachedBuildpack {
+			s.warn("\nNEW_RELIC_AGENT_VERSION env variable cannot be used with cached extension buildpack. Ignoring NEW_RELIC_AGENT_VERSION")
+		} else {
+			nrVersion = nrav
+			s.Log.Debug("NEW_RELIC_AGENT_VERSION specified by environment variable: <%s>", nrVersion)
+			// nrDownloadURL = ""
+		}
+	}
+	//////////////////////////////////////////////////////////////////////
+
+	//Begin: Download and Install
+	//Approach 1: Recommended by Pivotal, but only works for fixed dependency version and URL specified in the manifest and checks shasum256//
+	/*
+		// this approach is dependent on dependencies from manifest.yml file
+		// we use different approaches to obtain the agent
+		//	1 - using NEW_RELIC_DOWNLOAD_URL env var
+		//	2 - cached dependencies (use manifest dependency entries to copy the file from cache)
+		//	3 - if dependency is from buildoack's manifest, use Pivotal's standard InstallDependency()
+		// 		version "latest" from manifest dependencies (figures out the latest and composes the URL)
+
+		newrelicDependency := libbuildpack.Dependency{Name: "newrelic", Version: "7.1.229.0"}
+		if err := s.Manifest.InstallDependency(newrelicDependency, s.Stager.DepDir()); err != nil {
+			s.Log.Error("Error Installing  NewRelic Agent", err)
+			return err
+		}
+	*/
+
+	//Approach 2: Read download URL (folder portion only) and figure out the latest version
+
+	s.Log.Debug("Installing NewRelic Agent -- Install (dep) directory: %s", s.Stager.DepDir())
+
+	// get agent version
+	method := AgentFromManifest
+	if isAgentUrlEnvSet {
+		method = AgentFromDownloadURL
+
+		s.Log.Info("Using NEW_RELIC_DOWNLOAD_URL environment variable...")
+		nrDownloadURL = strings.TrimSpace(downloadURL)
+		nrDownloadFile = ""
+		if sha256, exists := s.env().LookupEnv("NEW_RELIC_DOWNLOAD_SHA256"); exists == true {
+			nrSha256Sum = sha256 // set by env var
+		} else {
+			nrSha256Sum = "" // ignore sha256 sum if not set by env var
+		}
+		newAgentLayout = updateFolderForNewerAgentVersions(s, nrDownloadURL, "")
+
+	} else if cachedBuildpack { // this file is cached by the buildpack
+		s.Log.Info("Using cached dependencies...")
+		if !filepath.IsAbs(nrDownloadFile) {
+			nrDownloadFile = filepath.Join(buildpackDir, nrDownloadFile)
+		}
+		newAgentLayout = updateFolderForNewerAgentVersions(s, nrDownloadFile, "")
+		method = AgentFromBuildpackCache
+
+	} else {
+		nrDownloadFile = ""
+
+		if nrDownloadURL == "" || isAgenVersionEnvSet || in_array(strings.ToLower(nrVersion), []string{"", "0.0.0", "0.0.0.0", "latest", "current"}) {
+			nrAgentVersion := nrVersion
+			if isAgenVersionEnvSet {
+				s.Log.Info("Obtaining requested agent version ")
+				method = AgentFromVersionEnv
+
+				v := strings.Split(string(nrAgentVersion), ".")
+				vc := len(v)
+				v1, _ := strconv.Atoi(v[0])
+				v2 := 0
+				if vc > 1 {
+					v2, _ = strconv.Atoi(v[1])
+				}
+
+				// Handle new versions
+				if v1 >= 10 {
+					newAgentLayout = true
+
+					// Handle previous versions
+				} else if v1 < 8 || (v1 == 8 && (v2 <= 25 || v2 == 27 || v2 == 28)) {
+					// pre-opensource versioning
+					nrAgentDownloadUrl, latestNrDownloadSha256Url = s.Platform.AgentURLs(true)
+					versionPattern = preOpenSourceNrVersionPattern
+
+					// Handle old versions
+				} else if vc == 4 {
+					nrAgentVersion = nrAgentVersion[0:strings.LastIndex(nrAgentVersion, ".")]
+				}
+			} else {
+				s.Log.Info("Obtaining latest agent version ")
+				method = AgentLatest
+				latestVersion, err := getLatestAgentVersion(s, versionPattern)
+				if err != nil {
+					s.Log.Error("Unable to obtain latest agent version from the metadata bucket: %s", err.Error())
+					return AgentSource{}, err
+				}
+				latestVersion = compatibleAgentVersion(s, latestVersion)
+				nrAgentVersion = latestVersion
+				nrVersion = latestVersion
+				newAgentLayout = compareVersions(latestVersion, "10.0") >= 0
+			}
+
+			s.Log.Debug("Using agent version: %s", nrAgentVersion)
+
+			// substitute agent version in the url
+			updatedUrl, err := substituteUrlVersion(s, nrAgentDownloadUrl, versionPattern, nrAgentVersion)
+			if err != nil {
+				s.Log.Error("filed to substitute agent version in url")
+				return AgentSource{}, err
+			}
+			nrDownloadURL = updatedUrl
+
+			// if agent is being downloaded read sha256 sum of the agent from NR download site
+
+			latestNrAgentSha256Sum, err := getLatestNrAgentSha256Sum(s, tmpDir, latestNrDownloadSha256Url, versionPattern, nrAgentVersion)
+			if err != nil {
+				s.Log.Error("Can't get SHA256 checksum for latest New Relic Agent download: %s", err.Error())
+				return AgentSource{}, err
+			}
+			nrSha256Sum = latestNrAgentSha256Sum
+
+		}
+	}
+
+	if method == AgentFromDownloadURL || method == AgentFromBuildpackCache {
+		nrVersion = versionFromURL(nrDownloadURL + " " + nrDownloadFile)
+	}
+	return AgentSource{
+		Method:    method,
+		URL:       nrDownloadURL,
+		File:      nrDownloadFile,
+		Version:   nrVersion,
+		SHA256:    nrSha256Sum,
+		NewLayout: newAgentLayout,
+	}, nil
+}
+
+// installAgent copies or downloads the agent archive to archive, verifies it and extracts it
+func installAgent(s *Supplier, source AgentSource, archive string) (string, error) {
+	// Start: downloading AgentFile ##############################################################################
+	if source.File != "" {
+		s.Log.Debug("Copy [%s]", source.File)
+		if err := libbuildpack.CopyFile(source.File, archive); err != nil {
+			return "", err
+		}
+	} else {
+		s.Log.BeginStep("Downloading New Relic agent...")
+		s.Log.Debug("downloading the agent using downloadDependency() ...")
+		if err := downloadDependency(s, source.URL, archive); err != nil {
+			return "", err
+		}
+	}
+
+	// compare sha256 sum of the downloaded file against expected sum
+	if source.SHA256 != "" {
+		if err := checkSha256(archive, source.SHA256); err != nil {
+			s.Log.Error("New Relic agent SHA256 checksum failed: %s", err.Error())
+			return "", err
+		}
+	}
+	// recorded in the SBOM even if no checksum was expected
+	archiveSha256, err := fileSha256(archive)
+	if err != nil {
+		return "", err
+	}
+	s.archiveSha256 = archiveSha256
+	// End: downloading AgentFile ################################################################################
+
+	// Start: extracting AgentFile ###############################################################################
+	nrAgentPath, err := s.Platform.ExtractAgent(s, archive, source.NewLayout)
+	if err != nil {
+		s.Log.Error("Error Extracting NewRelic %s Agent: %s", s.Platform.AgentName(), err.Error())
+		return "", err
+	}
+	// End: extracting AgentFile #################################################################################
+	return nrAgentPath, nil
+}
+
+// updateFolderForNewerAgentVersions reports if the agent in the url (or the version) has the folder structure of agent 10.0 and later
+func updateFolderForNewerAgentVersions(s *Supplier, url string, agentVersion string) bool {
+
+	if len(url) > 1 {
+		nrVersionPatternMatcher, err := regexp.Compile("((\\d{1,3}\\.){2}\\d{1,3})")
+		if err != nil {
+			s.Log.Error("failed to build rexexp pattern matcher")
+		}
+		result := nrVersionPatternMatcher.FindStringSubmatch(url)
+		if len(result) <= 0 {
+			s.Log.Error("Error: no version match found in url")
+		} else {
+			uriVersion := result[1] // version pattern found in the url
+
+			v := strings.Split(string(uriVersion), ".")
+			v1, _ := strconv.Atoi(v[0])
+
+			if v1 >= 10 {
+				return true
+			}
+		}
+
+	} else if len(agentVersion) > 1 {
+
+		v := strings.Split(string(agentVersion), ".")
+		v1, _ := strconv.Atoi(v[0])
+
+		if v1 >= 10 {
+			return true
+		}
+	}
+	return false
+}
+
+func detectNewRelicService(s *Supplier) bool {
+	s.Log.Info("Detecting New Relic...")
+
+	// check if the app requires to bind to new relic agent
+	binding := newRelicBinding(s)
+	bindNrAgent := binding != ""
+	s.Log.Debug("Checked New Relic")
+	s.Log.Debug("bindNrAgent: %v %s", bindNrAgent, binding)
+	return bindNrAgent
+}
+
+// newRelicBinding describes what binds the app to New Relic, or returns "" if nothing does
+func newRelicBinding(s *Supplier) string {
+	if _, exists := s.env().LookupEnv("NEW_RELIC_LICENSE_KEY"); exists {
+		return "NEW_RELIC_LICENSE_KEY is set"
+	} else if _, exists := s.env().LookupEnv("NEW_RELIC_DOWNLOAD_URL"); exists {
+		// must have license key in an NR service in VCAP_SERVICES or newrelic.config
+		return "NEW_RELIC_DOWNLOAD_URL is set"
+	}
+
+	if bindings := newRelicServiceBindings(s); len(bindings) > 0 {
+		return "bound to service binding \"" + bindings[0].Name + "\" of type " + newRelicBindingType
+	}
+
+	vcapServices, err := loadVcapServices(s)
+	if err != nil {
+		s.Log.Error("Unable to load the bound services: %s", err.Error())
+		return ""
+	}
+	// check for a service from newrelic service broker (or tile)
+	if _, exists := vcapServices["newrelic"].([]interface{}); exists {
+		return "bound to a newrelic service instance"
+	}
+	// check user-provided-services
+	userProvidedServicesElement, _ := vcapServices["user-provided"].([]interface{})
+	for _, ups := range userProvidedServicesElement {
+		service, _ := ups.(map[string]interface{})
+		serviceName, _ := service["name"].(string)
+		if strings.Contains(strings.ToLower(serviceName), "newrelic") {
+			return "bound to user-provided-service \"" + serviceName + "\""
+		}
+	}
+	return ""
+}
+
+// agentDisabled reports if NEW_RELIC_AGENT_ENABLED is set to false
+func agentDisabled(s *Supplier) bool {
+	return strings.EqualFold(strings.TrimSpace(s.getenv(agentEnabledEnvVar)), "false")
+}
+
+func (s *Supplier) env() Environment {
+	if s.Env == nil {
+		return osEnvironment{}
+	}
+	return s.Env
+}
+
+func (s *Supplier) getenv(name string) string {
+	value, _ := s.env().LookupEnv(name)
+	return value
+}
+
+func (s *Supplier) httpClient() HTTPClient {
+	if s.HTTPClient == nil {
+		return &http.Client{Timeout: time.Second * 10}
+	}
+	return s.HTTPClient
+}
+
+func (s *Supplier) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// Getenv returns an env var of the staging environment, "" if it isn't set
+func (s *Supplier) Getenv(name string) string {
+	return s.getenv(name)
+}
+
+// AgentEnv returns the agent env vars resolved from the staging environment, the bound services
+// and the bindings, like the launch helper resolves them when the app starts
+func (s *Supplier) AgentEnv() map[string]string {
+	if s.envVars == nil {
+		resolveAgentSettings(s)
+	}
+	return s.envVars
+}
+
+// AgentEnabled reports if NEW_RELIC_AGENT_ENABLED leaves the agent enabled during staging
+func (s *Supplier) AgentEnabled() bool {
+	return !agentDisabled(s)
+}
+
+// BuildpackDir is the folder of the extension buildpack, known once Run started
+func (s *Supplier) BuildpackDir() string {
+	return s.buildpackDir
+}
+
+// AgentSource returns the agent installed by Run, nil if Run didn't get that far
+func (s *Supplier) AgentSource() *AgentSource {
+	return s.agentSource
+}
+
+func getBuildpackDir(s *Supplier) (string, error) {
+	// get the buildpack directory
+	if buildpackDir := s.getenv("BUILDPACK_DIR"); buildpackDir != "" {
+		return buildpackDir, nil
+	}
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		s.Log.Error("Unable to determine buildpack directory: %s", err.Error())
+	}
+	return buildpackDir, err
+}
+
+// versionFromURL returns the agent version in an agent url or file name
+func versionFromURL(url string) string {
+	result := regexp.MustCompile("((\\d{1,3}\\.){2,3}\\d{1,3})").FindStringSubmatch(url)
+	if len(result) <= 1 {
+		return ""
+	}
+	return result[1]
+}
+
+func in_array(searchStr string, array []string) bool {
+	for _, v := range array {
+		if v == searchStr { // item found in array of strings
+			return true
+		}
+	}
+	return false
+}
+
+func substituteUrlVersion(s *Supplier, url string, nrVersionPattern string, nrVersion string) (string, error) {
+	s.Log.Debug("subsituting url version")
+	nrVersionPatternMatcher, err := regexp.Compile(nrVersionPattern)
+	if err != nil {
+		s.Log.Error("filed to build rexexp pattern matcher")
+		return "", err
+	}
+	result := nrVersionPatternMatcher.FindStringSubmatch(url)
+	if len(result) <= 0 {
+		return "", errors.New("Error: no version match found in url")
+	}
+	uriVersion := result[1] // version pattern found in the url
+
+	return strings.Replace(url, uriVersion, nrVersion, -1), nil
+}
+
+func getLatestNrAgentSha256Sum(s *Supplier, tmpDownloadDir string, latestNrDownloadSha256Url string, nrVersionPattern string, latestNrVersion string) (string, error) {
+	s.Log.Info("Obtaining Agent sha256 Sum from New Relic")
+	shaUrl, err := substituteUrlVersion(s, latestNrDownloadSha256Url, nrVersionPattern, latestNrVersion)
+	if err != nil {
+		s.Log.Error("filed to substitute agent version in sha256 url")
+		return "", err
+	}
+
+	sha256File := filepath.Join(tmpDownloadDir, "nragent.sha256")
+	if err := downloadDependency(s, shaUrl, sha256File); err != nil {
+		return "", err
+	}
+
+	sha256Sum, err := ioutil.ReadFile(sha256File)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Split(string(sha256Sum), " ")[0], nil
+}
+
+func downloadDependency(s *Supplier, url string, filepath string) (err error) {
+	s.Log.Debug("Downloading from [%s]", url)
+	s.Log.Debug("Saving to [%s]", filepath)
+
+	// Create the file
+	out, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Get the data
+	resp, err := s.httpClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Check server response
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("bad status: " + resp.Status)
+	}
+
+	// Writer the body to file
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkSha256(filePath, expectedSha256 string) error {
+	actualSha256, err := fileSha256(filePath)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(actualSha256) != strings.ToLower(expectedSha256) {
+		return errors.New("dependency sha256 mismatch: expected sha256: " + expectedSha256 + ", actual sha256: " + actualSha256)
+	}
+	return nil
+}
+
+func fileSha256(filePath string) (string, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func getNewRelicConfigFile(s *Supplier, nrAgentPath string, buildpackDir string) error {
+	origin, newrelicConfigFile, err := newRelicConfigOrigin(s, buildpackDir)
+	if err != nil {
+		return err
+	}
+	s.report.ConfigFile = origin
+	newrelicConfigDest := filepath.Join(nrAgentPath, "newrelic.config")
+	switch origin {
+	case ConfigFromApp:
+		// newrelic.config exists in app folder
+		addNewRelicConfigSecrets(s, newrelicConfigFile)
+		s.Log.Info("Using newrelic.config provided in the app folder")
+		s.Log.Debug("Copying %s to %s", newrelicConfigFile, newrelicConfigDest)
+		if err := libbuildpack.CopyFile(newrelicConfigFile, newrelicConfigDest); err != nil {
+			s.Log.Error("Error Copying newrelic.config provided within the app folder: %s", err.Error())
+			return err
+		}
+	case ConfigFromBuildpack:
+		// newrelic.config exists in buidpack folder
+		s.Log.Info("Using newrelic.config provided with the buildpack")
+		if err := libbuildpack.CopyFile(newrelicConfigFile, newrelicConfigDest); err != nil {
+			s.Log.Error("Error copying newrelic.config provided by the buildpack: %s", err.Error())
+			return err
+		}
+		s.Log.Info("Overwriting newrelic.config template provided with the buildpack")
+	default:
+		s.Log.Info("Using default newrelic.config downloaded with the agent")
+	}
+	return nil
+}
+
+// newRelicConfigOrigin decides which newrelic.config the agent uses: the one of the app folder,
+// else the one of the buildpack folder, else the default of the agent. It returns one of the
+// ConfigFrom* origins and the file to copy, "" for the default of the agent.
+func newRelicConfigOrigin(s *Supplier, buildpackDir string) (string, string, error) {
+	newrelicConfigBundledWithApp := filepath.Join(s.Stager.BuildDir(), "newrelic.config")
+	newrelicConfigBundledWithAppExists, err := libbuildpack.FileExists(newrelicConfigBundledWithApp)
+	if err != nil {
+		s.Log.Error("Unable to test existence of newrelic.config in app folder: %s", err.Error())
+		newrelicConfigBundledWithAppExists = false
+	}
+	if newrelicConfigBundledWithAppExists {
+		return ConfigFromApp, newrelicConfigBundledWithApp, nil
+	}
+
+	// check if newrelic.config exists in the buildpack folder
+	newrelicConfigBundledWithBuildPack := filepath.Join(buildpackDir, "newrelic.config")
+	newrelicConfigFileExists, err := libbuildpack.FileExists(newrelicConfigBundledWithBuildPack)
+	if err != nil {
+		s.Log.Error("Error checking if newrelic.confg exists in buildpack: %s", err.Error())
+		return "", "", err
+	}
+	if newrelicConfigFileExists {
+		return ConfigFromBuildpack, newrelicConfigBundledWithBuildPack, nil
+	}
+	return ConfigFromAgent, "", nil
+}
+
+func getNewRelicXmlInstrumentationFile(s *Supplier, nrAgentPath string) error {
+	newrelicXmlInstrumentation := filepath.Join(s.Stager.BuildDir(), "newrelic_instrumentation.xml")
+	newrelicConfigDest := filepath.Join(nrAgentPath, "extensions", "newrelic_instrumentation.xml")
+
+	newrelicXmlInstrumentationExists, err := libbuildpack.FileExists(newrelicXmlInstrumentation)
+	if err != nil {
+		s.Log.Debug("No custom instrumentation file found in app folder: %s", err.Error())
+		newrelicXmlInstrumentationExists = false
+	}
+
+	if newrelicXmlInstrumentationExists {
+		// newrelic XML instrumentation file found in app folder
+		s.Log.Info("Using custom instrumentation file \"newrelic_instrumentation.xml\" provided in the app folder")
+		s.Log.Debug("Copying %s to %s", newrelicXmlInstrumentation, newrelicConfigDest)
+		if err := libbuildpack.CopyFile(newrelicXmlInstrumentation, newrelicConfigDest); err != nil {
+			s.Log.Error("Error Copying newrelic_instrumentation.xml provided within the app folder: %s", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func buildProfileD(s *Supplier, nrAgentPath string) error {
+	script := NewScript(s.Platform.Dialect())
+
+	s.Log.Info("Enabling New Relic %s Profiler", s.Platform.AgentName())
+	agentRef, agentPath := s.Platform.AgentPath(s, nrAgentPath)
+	script.SkipIf(agentEnabledEnvVar, "false")
+	s.Platform.SetProfilerVars(s, script, agentRef, agentPath)
+
+	// resolved here only to warn early, the launch helper resolves them again when the app starts
+	s.AgentEnv()
+
+	if s.envVars["NEW_RELIC_LICENSE_KEY"] == "" {
+		s.warn("Please make sure New Relic License Key is defined by \"setting env var\", using \"user-provided-service\", \"service broker service instance\", or \"newrelic.config file\"")
+	}
+
+	script.EndSkip()
+
+	// the launch helper runs even if the agent is disabled, it then only writes the agent switch of the platform
+	var launchArguments []LaunchArgument
+	if configurer, ok := s.Platform.(LaunchConfigurer); ok {
+		launchArguments = configurer.LaunchArguments(s)
+	}
+	addLaunchHelperCommands(script, agentRef, agentPath, launchArguments...)
+
+	scriptFile, err := s.Platform.WriteScript(s, script)
+	if err != nil {
+		return err
+	}
+	if err := writeProfilerRecord(s, scriptFile, script.Vars()); err != nil {
+		return err
+	}
+	if err := verifyScriptPaths(s); err != nil {
+		return err
+	}
+	reportExportedEnv(s, script.Vars())
+	return publishInstalledAgent(s, scriptFile, script.Vars())
+}
+
+// resolveAgentSettings fills envVars and configSettings from the environment.
+// It runs during staging and again in the launch helper when the container starts.
+func resolveAgentSettings(s *Supplier) {
+	s.envVars = make(map[string]string)
+	s.configSettings = make(map[string]string)
+	s.settingOrigins = make(map[string]string)
+
+	// search criteria for app name and license key in ENV, VCAP_APPLICATION, VCAP_SERVICES
+	// order of precedence
+	//		1 check for app name in VCAP_APPLICATION
+	//		2 check for license key in the service broker instance from VCAP_SERVICES
+	//		3 overwrite with newrelic bindings under SERVICE_BINDING_ROOT (Service Binding for Kubernetes)
+	//		4 overwrite with New Relic USER-PROVIDED-SERVICE from VCAP_SERVICES
+	//		5 overwrite with New Relic environment variables -- highest precedence
+	//
+	// always look in binding and UPS credentials for other values that might be set (e.x. distributed tracing)
+
+	s.envVars["NEW_RELIC_APP_NAME"] = parseVcapApplicationEnv(s) // VCAP_APPLICATION -- always exists
+	s.settingOrigins["NEW_RELIC_APP_NAME"] = "VCAP_APPLICATION application_name"
+
+	// see if the app is bound to new relic svc broker instance
+	// VCAP_SERVICES, or the file of VCAP_SERVICES_FILE_PATH
+	vcapServices, err := loadVcapServices(s)
+	if err != nil {
+		s.Log.Error("Unable to load the bound services: %s", err.Error())
+	} else if vcapServices != nil {
+		s.envVars["NEW_RELIC_LICENSE_KEY"] = parseNewRelicService(s, vcapServices) // from svc-broker instance in VCAP_SERVICES
+		s.settingOrigins["NEW_RELIC_LICENSE_KEY"] = "licenseKey of the newrelic service instance"
+	}
+	parseServiceBindings(s)                    // fills envVars from the newrelic bindings under SERVICE_BINDING_ROOT if any
+	parseUserProvidedServices(s, vcapServices) // fills envVars with all other env vars from USER-PROVIDED-SERVICE in VCAP_SERVICES if any
+
+	// NEW_RELIC_APP_NAME env var always overwrites other app names
+	newrelicAppName := s.getenv("NEW_RELIC_APP_NAME")
+	if newrelicAppName > "" {
+		s.envVars["NEW_RELIC_APP_NAME"] = newrelicAppName
+		s.settingOrigins["NEW_RELIC_APP_NAME"] = "NEW_RELIC_APP_NAME env var"
+	}
+	// NEW_RELIC_LICENSE_KEY env var always overwrites other license keys
+	newrelicLicenseKey := s.getenv("NEW_RELIC_LICENSE_KEY")
+	if newrelicLicenseKey > "" {
+		s.envVars["NEW_RELIC_LICENSE_KEY"] = newrelicLicenseKey
+		s.settingOrigins["NEW_RELIC_LICENSE_KEY"] = "NEW_RELIC_LICENSE_KEY env var"
+	}
+}
+
+func parseVcapApplicationEnv(s *Supplier) string {
+	s.Log.Debug("Parsing VcapApplication env")
+	// NEW_RELIC_APP_NAME env var always overwrites other app names
+	newrelicAppName := s.getenv("NEW_RELIC_APP_NAME")
+	if newrelicAppName == "" {
+		vCapApplicationEnvValue := s.getenv("VCAP_APPLICATION")
+		var vcapApplication map[string]interface{}
+		if err := json.Unmarshal([]byte(vCapApplicationEnvValue), &vcapApplication); err != nil {
+			s.Log.Error("Unable to unmarshall VCAP_APPLICATION environment variable, NEW_RELIC_APP_NAME will not be set in profile script: %s", err.Error())
+		} else {
+			appName, ok := vcapApplication["application_name"].(string)
+			if ok {
+				s.Log.Info("VCAP_APPLICATION.application_name=%s", appName)
+				newrelicAppName = appName
+			}
+		}
+	}
+	return newrelicAppName
+}
+
+func parseNewRelicService(s *Supplier, vcapServices map[string]interface{}) string {
+	newrelicLicenseKey := ""
+	// check for a service from newrelic service broker (or tile)
+	newrelicElement, ok := vcapServices["newrelic"].([]interface{})
+	if ok {
+		if len(newrelicElement) > 0 {
+			newrelicMap, ok := newrelicElement[0].(map[string]interface{})
+			if ok {
+				credMap, ok := newrelicMap["credentials"].(map[string]interface{})
+				if ok {
+					newrelicLicense, ok := credMap["licenseKey"].(string)
+					if ok {
+						s.addSecret(newrelicLicense)
+						// s.Log.Info("VCAP_SERVICES.newrelic.credentials.licenseKey=" + "**Redacted**")
+						newrelicLicenseKey = newrelicLicense
+					}
+				}
+			}
+		}
+	}
+	return newrelicLicenseKey
+}
+
+func parseUserProvidedServices(s *Supplier, vcapServices map[string]interface{}) {
+	// check user-provided-services
+	userProvidesServicesElement, _ := vcapServices["user-provided"].([]interface{})
+	for _, ups := range userProvidesServicesElement {
+		element, _ := ups.(map[string]interface{})
+		serviceName, _ := element["name"].(string)
+		if found := strings.Contains(strings.ToLower(serviceName), "newrelic"); found == true {
+			cmap, _ := element["credentials"].(map[string]interface{})
+			applyServiceCredentials(s, "user-provided-service \""+serviceName+"\"", "VCAP_SERVICES."+serviceName+".credentials.", cmap)
+		}
+	}
+}
+
+// parseServiceBindings applies the credentials of the newrelic bindings under SERVICE_BINDING_ROOT
+func parseServiceBindings(s *Supplier) {
+	for _, binding := range newRelicServiceBindings(s) {
+		s.Log.Debug("Using service binding %s (provider %s)", binding.Name, binding.Provider)
+		applyServiceCredentials(s, "service binding \""+binding.Name+"\"", serviceBindingRootEnvVar+"/"+binding.Name+"/", binding.Credentials)
+	}
+}
+
+// applyServiceCredentials maps the credentials of a binding to envVars and configSettings.
+// service describes the binding in warnings, and logPrefix prefixes the credential keys in debug logs.
+func applyServiceCredentials(s *Supplier, service string, logPrefix string, credentials map[string]interface{}) {
+	for key, cred := range credentials {
+		if key == "" {
+			continue
+		}
+		// only credentials listed in the mapping file (or NEW_RELIC_* pass-throughs) are used
+		mapping, ok := findCredentialMapping(s, key)
+		if !ok {
+			s.warn("Ignoring credential \"%s\" of %s: not a known New Relic setting", key, service)
+			continue
+		}
+		value, ok := credentialValue(cred)
+		if !ok {
+			s.warn("Ignoring credential \"%s\" of %s: unsupported value type", key, service)
+			continue
+		}
+		if value == "" {
+			continue
+		}
+		value, err := transformCredentialValue(mapping.Transform, value)
+		if err != nil {
+			s.warn("Ignoring credential \"%s\" of %s: %s", key, service, err.Error())
+			continue
+		}
+		if mapping.Secret || secretEnvVar(mapping.Env) {
+			s.addSecret(value)
+			s.Log.Debug("%s%s=**redacted**", logPrefix, key)
+		} else {
+			s.Log.Debug("%s%s=%s", logPrefix, key, value)
+		}
+		if mapping.Config != "" {
+			s.configSettings[mapping.Config] = value // written to newrelic.config after the agent is installed
+			s.settingOrigins[mapping.Config] = "credential \"" + key + "\" of " + service
+		} else {
+			s.envVars[mapping.Env] = value // save the mapped creds for adding to the app env
+			s.settingOrigins[mapping.Env] = "credential \"" + key + "\" of " + service
+		}
+	}
+}
+
+func writeToFile(source io.Reader, destFile string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(destFile), 0755)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = io.Copy(fh, source)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func getLatestAgentVersion(s *Supplier, nrVersionPattern string) (string, error) {
+	latestAgentVersion := ""
+	resp, err := s.httpClient().Get(bucketXMLUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Check server response
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("Bad http status when downloading XML meta data: " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.NewBuffer(data)
+	dec := xml.NewDecoder(buf)
+
+	var listBucketResultNode bucketResultXMLNode
+	err = dec.Decode(&listBucketResultNode)
+	if err != nil {
+		return "", err
+	}
+
+	for _, nc := range listBucketResultNode.Nodes {
+		if nc.XMLName.Local == "Contents" {
+			key := ""
+			for _, nc2 := range nc.Nodes {
+				if nc2.XMLName.Local == "Key" {
+					key = string(nc2.Content)
+					break
+				}
+			}
+			nrVersionPatternMatcher, err := regexp.Compile(nrVersionPattern)
+			if err != nil {
+				return "", err
+			}
+
+			result := nrVersionPatternMatcher.FindStringSubmatch(key)
+			if len(result) > 1 {
+				latestAgentVersion = result[1]
+			}
+		}
+	}
+	return latestAgentVersion, nil
+}
@@ -0,0 +1,709 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Supplier", func() {
+	const licenseKey = "0123456789abcdef0123456789abcdef01234567"
+	const downloadURL = "https://artifacts.example.com/agents/newrelic-dotnet-agent_10.20.1_amd64.tar.gz"
+	const vcapApplication = `{"application_name":"vcap-app"}`
+
+	var (
+		root         string
+		buildpackDir string
+		buffer       *bytes.Buffer
+		stager       *fakeStager
+		env          fakeEnvironment
+		httpClient   *fakeHTTPClient
+		clock        *fakeClock
+		supplier     *Supplier
+		archive      []byte
+	)
+
+	sha256Sum := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:])
+	}
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	readFile := func(name string) string {
+		content, err := ioutil.ReadFile(name)
+		Expect(err).NotTo(HaveOccurred())
+		return string(content)
+	}
+
+	useManifest := func(content string) {
+		writeFile(filepath.Join(buildpackDir, "manifest.yml"), content)
+		manifest, err := libbuildpack.NewManifest(buildpackDir, supplier.Log, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		supplier.Manifest = manifest
+	}
+
+	profileD := func() string {
+		return readFile(filepath.Join(stager.DepDir(), "profile.d", "newrelic.sh"))
+	}
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "nrbuildpack")
+		Expect(err).NotTo(HaveOccurred())
+
+		buildpackDir = filepath.Join(root, "buildpack")
+		writeFile(filepath.Join(buildpackDir, "bin", launchHelperName), "#!/bin/sh\n")
+
+		buffer = new(bytes.Buffer)
+		redactor := NewRedactor(buffer)
+		stager = newFakeStager(root)
+		env = fakeEnvironment{
+			"BUILDPACK_DIR":    buildpackDir,
+			"VCAP_APPLICATION": vcapApplication,
+		}
+		httpClient = newFakeHTTPClient()
+		clock = &fakeClock{now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), step: time.Second}
+		supplier = &Supplier{
+			Stager:       stager,
+			Log:          libbuildpack.NewLogger(redactor),
+			Redactor:     redactor,
+			Platform:     &fakePlatform{},
+			Env:          env,
+			HTTPClient:   httpClient,
+			Now:          clock.Now,
+			LaunchHelper: filepath.Join(buildpackDir, "bin", launchHelperName),
+		}
+		useManifest("---\nlanguage: fake\ndependencies: []\n")
+
+		archive = agentArchive("newrelic-dotnet-agent", map[string]string{
+			"libNewRelicProfiler.so": "profiler",
+			"newrelic.config":        "<configuration/>",
+		})
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	Describe("Run", func() {
+		It("does nothing without a New Relic service", func() {
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(buffer.String()).To(ContainSubstring("No New Relic service to bind to"))
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(filepath.Join(stager.DepDir(), "profile.d")).NotTo(BeADirectory())
+		})
+
+		Context("with NEW_RELIC_DOWNLOAD_URL", func() {
+			BeforeEach(func() {
+				env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+				env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+				httpClient.respond(downloadURL, http.StatusOK, string(archive))
+			})
+
+			It("installs the agent from the url and writes the profile.d script", func() {
+				Expect(supplier.Run()).To(Succeed())
+
+				Expect(httpClient.requests).To(Equal([]string{downloadURL}))
+				agentDir := filepath.Join(stager.DepDir(), "newrelic-dotnet-agent")
+				Expect(filepath.Join(agentDir, "libNewRelicProfiler.so")).To(BeARegularFile())
+				Expect(filepath.Join(agentDir, launchHelperName)).To(BeARegularFile())
+				Expect(filepath.Join(agentDir, launchMappingFileName)).To(BeARegularFile())
+				Expect(filepath.Join(stager.DepDir(), profilerRecordFileName)).To(BeARegularFile())
+				Expect(profileD()).To(ContainSubstring(`export CORECLR_NEWRELIC_HOME="${DEPS_DIR}/0/newrelic-dotnet-agent"`))
+				Expect(profileD()).To(ContainSubstring("newrelic-launch"))
+				Expect(profileD()).NotTo(ContainSubstring(licenseKey))
+				Expect(buffer.String()).NotTo(ContainSubstring(licenseKey))
+			})
+
+			It("passes the arguments of the platform to the launch helper", func() {
+				supplier.Platform = &fakeLaunchPlatform{}
+
+				Expect(supplier.Run()).To(Succeed())
+
+				Expect(profileD()).To(ContainSubstring(`/newrelic.config" -web-config "${HOME}/Web.config" -web-config-override)"`))
+			})
+
+			It("lists every agent of the archive in the SBOM", func() {
+				supplier.Platform = &fakeRootPlatform{}
+
+				Expect(supplier.Run()).To(Succeed())
+
+				sbom := readFile(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent.cdx.json"))
+				Expect(sbom).To(ContainSubstring(`"name": "newrelic-dotnet-agent/libNewRelicProfiler.so"`))
+			})
+
+			It("runs the launch helper even if the agent is disabled", func() {
+				Expect(supplier.Run()).To(Succeed())
+
+				Expect(profileD()).To(MatchRegexp(`(?s)\nfi\neval "\$\(.*/newrelic-launch" -format sh`))
+			})
+
+			It("publishes the installed agent for the next buildpacks", func() {
+				Expect(supplier.Run()).To(Succeed())
+
+				agentDir := filepath.Join(stager.DepDir(), "newrelic-dotnet-agent")
+				Expect(supplier.InstalledAgent()).To(Equal(&InstalledAgent{
+					Version: "10.20.1",
+					Home:    agentDir,
+					Source:  AgentFromDownloadURL,
+					URL:     downloadURL,
+				}))
+				Expect(supplier.ConfigYml()).To(Equal(map[string]interface{}{"agent": supplier.InstalledAgent()}))
+				Expect(readFile(filepath.Join(stager.DepDir(), "env", agentHomeEnvFile))).To(Equal(agentDir))
+				Expect(readFile(filepath.Join(stager.DepDir(), "env", agentVersionEnvFile))).To(Equal("10.20.1"))
+				Expect(readFile(filepath.Join(stager.DepDir(), "env", agentSourceEnvFile))).To(Equal("download_url"))
+				Expect(filepath.Join(stager.DepDir(), "env", profilerPathEnvFile)).NotTo(BeAnExistingFile())
+
+				delete(env, "NEW_RELIC_LICENSE_KEY")
+				delete(env, "NEW_RELIC_DOWNLOAD_URL")
+				Expect(supplier.Run()).To(Succeed())
+				Expect(supplier.InstalledAgent()).To(BeNil())
+				Expect(supplier.ConfigYml()).To(BeNil())
+			})
+
+			It("verifies NEW_RELIC_DOWNLOAD_SHA256", func() {
+				env["NEW_RELIC_DOWNLOAD_SHA256"] = sha256Sum(archive)
+				Expect(supplier.Run()).To(Succeed())
+
+				env["NEW_RELIC_DOWNLOAD_SHA256"] = sha256Sum([]byte("another agent"))
+				Expect(supplier.Run()).To(MatchError(ContainSubstring("dependency sha256 mismatch")))
+			})
+
+			It("fails when the download fails", func() {
+				httpClient.respond(downloadURL, http.StatusForbidden, "")
+
+				Expect(supplier.Run()).To(MatchError("bad status: 403 Forbidden"))
+			})
+
+			It("uses newrelic.config of the app over the one of the buildpack", func() {
+				writeFile(filepath.Join(buildpackDir, "newrelic.config"), "<configuration buildpack=\"true\"/>")
+				Expect(supplier.Run()).To(Succeed())
+				Expect(readFile(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", "newrelic.config"))).To(ContainSubstring("buildpack"))
+
+				writeFile(filepath.Join(stager.BuildDir(), "newrelic.config"), "<configuration app=\"true\"/>")
+				Expect(supplier.Run()).To(Succeed())
+				Expect(readFile(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", "newrelic.config"))).To(ContainSubstring("app"))
+			})
+
+			It("reads the clock when the run and each step start and end", func() {
+				Expect(supplier.Run()).To(Succeed())
+
+				Expect(clock.now).To(Equal(time.Date(2026, 1, 2, 3, 4, 17, 0, time.UTC)))
+				Expect(supplier.Report().StagedAt).To(Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+				Expect(supplier.Report().DurationMs).To(Equal(int64(11000)))
+				Expect(supplier.Report().Steps).To(Equal([]ReportStep{
+					{Name: "resolve agent", Outcome: StepSucceeded, DurationMs: 1000},
+					{Name: "install agent", Outcome: StepSucceeded, DurationMs: 1000},
+					{Name: "configure agent", Outcome: StepSucceeded, DurationMs: 1000},
+					{Name: "enable profiler", Outcome: StepSucceeded, DurationMs: 1000},
+					{Name: "write sbom", Outcome: StepSucceeded, DurationMs: 1000},
+				}))
+			})
+
+			It("writes the staging report in the droplet", func() {
+				env["NEW_RELIC_DOWNLOAD_SHA256"] = sha256Sum(archive)
+				env["VCAP_SERVICES"] = `{"user-provided":[{"name":"newrelic","credentials":{"app_name":"ups-app","unknown":"value"}}]}`
+				Expect(supplier.Run()).To(Succeed())
+
+				var report StagingReport
+				Expect(json.Unmarshal([]byte(readFile(filepath.Join(stager.DepDir(), stagingReportFileName))), &report)).To(Succeed())
+				Expect(report.Extension).To(Equal("Fake"))
+				Expect(report.Agent).To(Equal(ReportAgent{
+					Version:      "10.20.1",
+					Source:       AgentFromDownloadURL,
+					URL:          downloadURL,
+					SHA256:       sha256Sum(archive),
+					Verification: VerifiedSHA256,
+					Home:         filepath.Join(stager.DepDir(), "newrelic-dotnet-agent"),
+				}))
+				Expect(report.ConfigFile).To(Equal(ConfigFromAgent))
+				Expect(report.ExportedEnv).To(Equal([]string{"CORECLR_ENABLE_PROFILING", "CORECLR_NEWRELIC_HOME", "NEW_RELIC_APP_NAME", "NEW_RELIC_LICENSE_KEY"}))
+				Expect(report.Warnings).To(ConsistOf(ContainSubstring(`Ignoring credential "unknown"`)))
+				Expect(readFile(filepath.Join(stager.DepDir(), stagingReportFileName))).NotTo(ContainSubstring(licenseKey))
+				Expect(report.SBOM).To(Equal([]string{
+					filepath.Join(stager.DepDir(), "newrelic-dotnet-agent.cdx.json"),
+					filepath.Join(stager.DepDir(), "newrelic-dotnet-agent.spdx.json"),
+				}))
+				Expect(readFile(report.SBOM[0])).To(ContainSubstring(`"name": "libNewRelicProfiler.so"`))
+				Expect(buffer.String()).To(ContainSubstring("New Relic agent 10.20.1 from download_url (" + downloadURL + "), verification: sha256, newrelic.config: agent, 1 warning(s)"))
+			})
+
+			It("records the failed step", func() {
+				httpClient.respond(downloadURL, http.StatusForbidden, "")
+
+				Expect(supplier.Run()).NotTo(Succeed())
+				Expect(supplier.Report().Steps).To(HaveLen(2))
+				Expect(supplier.Report().Steps[1]).To(Equal(ReportStep{
+					Name:          "install agent",
+					Outcome:       StepFailed,
+					DurationMs:    1000,
+					Error:         "bad status: 403 Forbidden",
+					ErrorCategory: ErrorNetwork,
+					Remediation:   remediationHints[ErrorNetwork],
+				}))
+			})
+
+			It("writes a JSON event per step with NEW_RELIC_BUILDPACK_LOG_FORMAT=json", func() {
+				env[logFormatEnvVar] = "json"
+				httpClient.respond(downloadURL, http.StatusForbidden, "")
+
+				Expect(supplier.Run()).NotTo(Succeed())
+
+				var steps []map[string]interface{}
+				for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+					var event map[string]interface{}
+					Expect(json.Unmarshal([]byte(line), &event)).To(Succeed(), line)
+					if event["event"] == "step" {
+						steps = append(steps, event)
+					}
+				}
+				Expect(steps).To(Equal([]map[string]interface{}{
+					{"event": "step", "extension": "Fake", "name": "resolve agent", "outcome": StepSucceeded, "duration_ms": 1000.0},
+					{"event": "step", "extension": "Fake", "name": "install agent", "outcome": StepFailed, "duration_ms": 1000.0,
+						"error": "bad status: 403 Forbidden", "error_category": ErrorNetwork, "remediation": remediationHints[ErrorNetwork]},
+				}))
+				Expect(buffer.String()).To(ContainSubstring(`{"event":"log","level":"step","message":"Supplying Newrelic Fake Extension"}`))
+				Expect(buffer.String()).NotTo(ContainSubstring(licenseKey))
+
+				// the text output is back after the run
+				supplier.Log.Info("after the run")
+				Expect(buffer.String()).To(HaveSuffix("       after the run\n"))
+			})
+		})
+
+		It("installs the latest agent found in the metadata bucket", func() {
+			useManifest("---\nlanguage: fake\ndependencies:\n- name: newrelic\n  version: latest\n  uri: " + fakeAgentURL + "\n")
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			httpClient.respond(bucketXMLUrl, http.StatusOK, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult>
+  <Name>nr-downloads-main</Name>
+  <Contents><Key>dot_net_agent/latest_release/</Key></Contents>
+  <Contents><Key>dot_net_agent/latest_release/newrelic-dotnet-agent_10.20.1_amd64.tar.gz</Key></Contents>
+</ListBucketResult>`)
+			agentURL := "http://download.example.com/dot_net_agent/previous_releases/10.20.1/newrelic-dotnet-agent_10.20.1_amd64.tar.gz"
+			sha256URL := "http://download.example.com/dot_net_agent/previous_releases/10.20.1/SHA256/newrelic-dotnet-agent_10.20.1_amd64.tar.gz.sha256"
+			httpClient.respond(sha256URL, http.StatusOK, sha256Sum(archive)+"  newrelic-dotnet-agent_10.20.1_amd64.tar.gz\n")
+			httpClient.respond(agentURL, http.StatusOK, string(archive))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(Equal([]string{bucketXMLUrl, sha256URL, agentURL}))
+			Expect(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", "libNewRelicProfiler.so")).To(BeARegularFile())
+			Expect(supplier.AgentSource()).To(Equal(&AgentSource{
+				Method:    AgentLatest,
+				URL:       agentURL,
+				Version:   "10.20.1",
+				SHA256:    sha256Sum(archive),
+				NewLayout: true,
+			}))
+		})
+
+		It("installs the newest agent supporting the runtime of the app instead of the latest", func() {
+			useManifest("---\nlanguage: fake\ndependencies:\n- name: newrelic\n  version: latest\n  uri: " + fakeAgentURL + "\n")
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			writeFile(filepath.Join(stager.BuildDir(), "App.runtimeconfig.json"),
+				`{"runtimeOptions":{"tfm":"netcoreapp3.0","framework":{"name":"Microsoft.NETCore.App","version":"3.0.0"}}}`)
+			httpClient.respond(bucketXMLUrl, http.StatusOK, `<ListBucketResult>
+  <Contents><Key>dot_net_agent/latest_release/newrelic-dotnet-agent_10.20.1_amd64.tar.gz</Key></Contents>
+</ListBucketResult>`)
+			agentURL := "http://download.example.com/dot_net_agent/previous_releases/9.9.0/newrelic-dotnet-agent_9.9.0_amd64.tar.gz"
+			sha256URL := "http://download.example.com/dot_net_agent/previous_releases/9.9.0/SHA256/newrelic-dotnet-agent_9.9.0_amd64.tar.gz.sha256"
+			httpClient.respond(sha256URL, http.StatusOK, sha256Sum(archive)+"  newrelic-dotnet-agent_9.9.0_amd64.tar.gz\n")
+			httpClient.respond(agentURL, http.StatusOK, string(archive))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(Equal([]string{bucketXMLUrl, sha256URL, agentURL}))
+			Expect(buffer.String()).To(ContainSubstring("Using agent 9.9.0 instead of the latest agent 10.20.1"))
+			Expect(supplier.AgentSource().Version).To(Equal("9.9.0"))
+			Expect(supplier.AgentSource().NewLayout).To(BeFalse())
+			Expect(supplier.Report().Warnings).To(BeEmpty())
+		})
+
+		It("fails the staging of a Native AOT app with NEW_RELIC_RUNTIME_CHECK=fail", func() {
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+			env[runtimeCheckEnvVar] = "fail"
+			writeFile(filepath.Join(stager.BuildDir(), "App.csproj"),
+				"<Project><PropertyGroup><TargetFramework>net8.0</TargetFramework><PublishAot>true</PublishAot></PropertyGroup></Project>")
+
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("Native AOT apps can't be profiled by any agent")))
+
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(supplier.Report().Steps).To(HaveLen(1))
+			Expect(supplier.Report().Steps[0].Name).To(Equal("resolve agent"))
+			Expect(supplier.Report().Steps[0].ErrorCategory).To(Equal(ErrorCompatibility))
+		})
+
+		It("installs a pre open source agent requested by NEW_RELIC_AGENT_VERSION", func() {
+			archive = agentArchive("newrelic-netcore20-agent", map[string]string{"libNewRelicProfiler.so": "profiler"})
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			env["NEW_RELIC_AGENT_VERSION"] = "8.21.34.0"
+			agentURL := "http://download.example.com/dot_net_agent/previous_releases/8.21.34.0/newrelic-netcore20-agent_8.21.34.0_amd64.tar.gz"
+			sha256URL := "http://download.example.com/dot_net_agent/previous_releases/8.21.34.0/SHA256/newrelic-netcore20-agent_8.21.34.0_amd64.tar.gz.sha256"
+			httpClient.respond(sha256URL, http.StatusOK, sha256Sum(archive))
+			httpClient.respond(agentURL, http.StatusOK, string(archive))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(Equal([]string{sha256URL, agentURL}))
+			Expect(profileD()).To(ContainSubstring(`"${DEPS_DIR}/0/newrelic-netcore20-agent"`))
+		})
+
+		It("installs an agent requested by a major NEW_RELIC_AGENT_VERSION", func() {
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			env["NEW_RELIC_AGENT_VERSION"] = "10"
+			agentURL := "http://download.example.com/dot_net_agent/previous_releases/10/newrelic-dotnet-agent_10_amd64.tar.gz"
+			sha256URL := "http://download.example.com/dot_net_agent/previous_releases/10/SHA256/newrelic-dotnet-agent_10_amd64.tar.gz.sha256"
+			httpClient.respond(sha256URL, http.StatusOK, sha256Sum(archive))
+			httpClient.respond(agentURL, http.StatusOK, string(archive))
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(Equal([]string{sha256URL, agentURL}))
+			Expect(profileD()).To(ContainSubstring(`"${DEPS_DIR}/0/newrelic-dotnet-agent"`))
+		})
+
+		It("installs the agent cached with the buildpack", func() {
+			writeFile(filepath.Join(buildpackDir, "dependencies", "agent.tar.gz"), string(archive))
+			useManifest("---\nlanguage: fake\ndependencies:\n- name: newrelic\n  version: 10.20.1\n" +
+				"  uri: " + downloadURL + "\n  file: dependencies/agent.tar.gz\n  sha256: " + sha256Sum(archive) + "\n")
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", "libNewRelicProfiler.so")).To(BeARegularFile())
+		})
+
+		It("skips the installation when the agent is disabled and NEW_RELIC_SKIP_INSTALL_WHEN_DISABLED is set", func() {
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+			env[agentEnabledEnvVar] = "false"
+			env[skipInstallWhenDisabledEnvVar] = "true"
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("skipping agent installation"))
+		})
+
+		It("keeps no state from a previous run", func() {
+			env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"newrelic","credentials":{"license_key":"` + licenseKey + `","NEW_RELIC_LABELS":"team:a","proxy_host":"proxy.example.com"}}]}`
+			env[credentialMappingFileEnvVar] = "mappings.yml"
+			writeFile(filepath.Join(stager.BuildDir(), "mappings.yml"), "mappings:\n- keys: [PROXY_HOST]\n  config: service/proxy@host\n")
+			httpClient.respond(downloadURL, http.StatusOK, string(archive))
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_LABELS", "team:a"))
+			Expect(supplier.configSettings).To(HaveKeyWithValue("service/proxy@host", "proxy.example.com"))
+			mappingFile := filepath.Join(stager.DepDir(), "newrelic-dotnet-agent", launchMappingFileName)
+			Expect(readFile(mappingFile)).To(ContainSubstring("PROXY_HOST"))
+
+			delete(env, credentialMappingFileEnvVar)
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"newrelic","credentials":{"license_key":"` + licenseKey + `"}}]}`
+
+			Expect(supplier.Run()).To(Succeed())
+			Expect(supplier.envVars).NotTo(HaveKey("NEW_RELIC_LABELS"))
+			Expect(supplier.configSettings).To(BeEmpty())
+			Expect(readFile(mappingFile)).NotTo(ContainSubstring("PROXY_HOST"))
+		})
+	})
+
+	Describe("dry run", func() {
+		BeforeEach(func() {
+			env[dryRunEnvVar] = "true"
+		})
+
+		It("explains the latest agent without downloading or installing it", func() {
+			useManifest("---\nlanguage: fake\ndependencies:\n- name: newrelic\n  version: latest\n  uri: " + fakeAgentURL + "\n")
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+			httpClient.respond(bucketXMLUrl, http.StatusOK, `<ListBucketResult>
+  <Contents><Key>dot_net_agent/latest_release/newrelic-dotnet-agent_10.20.1_amd64.tar.gz</Key></Contents>
+</ListBucketResult>`)
+			sha256URL := "http://download.example.com/dot_net_agent/previous_releases/10.20.1/SHA256/newrelic-dotnet-agent_10.20.1_amd64.tar.gz.sha256"
+			httpClient.respond(sha256URL, http.StatusOK, sha256Sum(archive)+"  newrelic-dotnet-agent_10.20.1_amd64.tar.gz\n")
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(Equal([]string{bucketXMLUrl, sha256URL}))
+			files, err := ioutil.ReadDir(stager.DepDir())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("|-- service: bound\n"))
+			Expect(buffer.String()).To(ContainSubstring("rule: NEW_RELIC_LICENSE_KEY is set\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- source: latest\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- version: 10.20.1\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- runtime: unknown\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- checksum: " + sha256Sum(archive) + "\n"))
+			Expect(buffer.String()).To(ContainSubstring("rule: SHA256 file published with the release\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- newrelic.config: agent\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- CORECLR_NEWRELIC_HOME: DEPS_DIR:/0/newrelic-dotnet-agent\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- NEW_RELIC_APP_NAME: vcap-app\n"))
+			Expect(buffer.String()).To(ContainSubstring("rule: VCAP_APPLICATION application_name\n"))
+			Expect(buffer.String()).To(ContainSubstring("`-- NEW_RELIC_LICENSE_KEY: **redacted**\n"))
+			Expect(buffer.String()).NotTo(ContainSubstring(licenseKey))
+		})
+
+		It("names the credential and the file which decided each item", func() {
+			env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+			env["NEW_RELIC_DOWNLOAD_SHA256"] = sha256Sum(archive)
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"my-newrelic","credentials":{"license_key":"` + licenseKey + `","app_name":"ups-app"}}]}`
+			writeFile(filepath.Join(stager.BuildDir(), "newrelic.config"), "<configuration/>")
+
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("rule: NEW_RELIC_DOWNLOAD_URL is set, it takes precedence over every other source\n"))
+			Expect(buffer.String()).To(ContainSubstring("rule: NEW_RELIC_DOWNLOAD_SHA256\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- newrelic.config: app\n"))
+			Expect(buffer.String()).To(ContainSubstring("|-- NEW_RELIC_APP_NAME: ups-app\n"))
+			Expect(buffer.String()).To(ContainSubstring(`rule: credential "app_name" of user-provided-service "my-newrelic"`))
+			Expect(buffer.String()).To(ContainSubstring(`rule: credential "license_key" of user-provided-service "my-newrelic"`))
+			Expect(filepath.Join(stager.DepDir(), "profile.d")).NotTo(BeADirectory())
+			Expect(filepath.Join(stager.DepDir(), stagingReportFileName)).NotTo(BeAnExistingFile())
+		})
+
+		It("explains why the agent is not installed", func() {
+			Expect(supplier.Run()).To(Succeed())
+
+			Expect(httpClient.requests).To(BeEmpty())
+			Expect(buffer.String()).To(ContainSubstring("`-- service: not bound\n"))
+		})
+	})
+
+	Describe("LaunchSettings.SetAppSettings", func() {
+		var webConfig string
+
+		BeforeEach(func() {
+			webConfig = filepath.Join(stager.BuildDir(), "Web.config")
+			writeFile(webConfig, "<configuration>\n  <appSettings>\n    <add key=\"NewRelic.AppName\" value=\"mine\" />\n  </appSettings>\n</configuration>\n")
+		})
+
+		It("sets the app name and the agent switch of the starting container", func() {
+			env["NEW_RELIC_APP_NAME"] = "renamed-app"
+
+			settings, err := resolveLaunch(supplier, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			set, kept, err := settings.SetAppSettings(webConfig, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(set).To(ConsistOf("NewRelic.AppName", "NewRelic.AgentEnabled"))
+			Expect(kept).To(BeEmpty())
+			Expect(readFile(webConfig)).To(Equal("<configuration>\n  <appSettings>\n" +
+				"    <add key=\"NewRelic.AppName\" value=\"renamed-app\" />\n" +
+				"    <add key=\"NewRelic.AgentEnabled\" value=\"true\" />\n  </appSettings>\n</configuration>\n"))
+		})
+
+		It("keeps the settings of the app unless told to replace them", func() {
+			settings, err := resolveLaunch(supplier, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			set, kept, err := settings.SetAppSettings(webConfig, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(set).To(Equal([]string{"NewRelic.AgentEnabled"}))
+			Expect(kept).To(Equal([]string{"NewRelic.AppName"}))
+			Expect(readFile(webConfig)).To(ContainSubstring("<add key=\"NewRelic.AppName\" value=\"mine\" />"))
+		})
+
+		It("turns the agent off when the container starts with the agent disabled", func() {
+			env["NEW_RELIC_AGENT_ENABLED"] = "false"
+			env["NEW_RELIC_LICENSE_KEY"] = "0000000000000000000000000000000000000000"
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"my-newrelic","credentials":{"app_name":"ups-app","distributed_tracing":"true"}}]}`
+
+			settings, err := resolveLaunch(supplier, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(settings.Env).To(BeEmpty())
+			Expect(settings.AppName).To(BeEmpty())
+			set, kept, err := settings.SetAppSettings(webConfig, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(set).To(Equal([]string{"NewRelic.AgentEnabled"}))
+			Expect(kept).To(BeEmpty())
+			Expect(readFile(webConfig)).To(ContainSubstring("<add key=\"NewRelic.AgentEnabled\" value=\"false\" />"))
+			Expect(readFile(webConfig)).To(ContainSubstring("<add key=\"NewRelic.AppName\" value=\"mine\" />"))
+		})
+	})
+
+	Describe("resolveAgentSettings", func() {
+		const brokerKey = "1111111111111111111111111111111111111111"
+		const upsKey = "2222222222222222222222222222222222222222"
+
+		BeforeEach(func() {
+			env["VCAP_SERVICES"] = `{
+				"newrelic": [{"name": "nr-broker", "credentials": {"licenseKey": "` + brokerKey + `"}}],
+				"user-provided": [
+					{"name": "my-newrelic", "credentials": {"license_key": "` + upsKey + `", "app_name": "ups-app", "distributed_tracing": "TRUE", "unknown": "value"}},
+					{"name": "database", "credentials": {"NEW_RELIC_LABELS": "ignored"}}
+				]
+			}`
+		})
+
+		It("gives user-provided services precedence over the service broker and VCAP_APPLICATION", func() {
+			resolveAgentSettings(supplier)
+
+			Expect(supplier.envVars).To(Equal(map[string]string{
+				"NEW_RELIC_APP_NAME":                    "ups-app",
+				"NEW_RELIC_LICENSE_KEY":                 upsKey,
+				"NEW_RELIC_DISTRIBUTED_TRACING_ENABLED": "true",
+			}))
+			Expect(buffer.String()).To(ContainSubstring(`Ignoring credential "unknown"`))
+		})
+
+		It("gives env vars precedence over everything else", func() {
+			env["NEW_RELIC_APP_NAME"] = "env-app"
+			env["NEW_RELIC_LICENSE_KEY"] = licenseKey
+
+			resolveAgentSettings(supplier)
+
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_APP_NAME", "env-app"))
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_LICENSE_KEY", licenseKey))
+		})
+
+		It("uses the service broker and VCAP_APPLICATION without user-provided services", func() {
+			env["VCAP_SERVICES"] = `{"newrelic": [{"name": "nr-broker", "credentials": {"licenseKey": "` + brokerKey + `"}}]}`
+
+			resolveAgentSettings(supplier)
+
+			Expect(supplier.envVars).To(Equal(map[string]string{
+				"NEW_RELIC_APP_NAME":    "vcap-app",
+				"NEW_RELIC_LICENSE_KEY": brokerKey,
+			}))
+		})
+	})
+
+	Describe("loadVcapServices", func() {
+		var vcapFile string
+
+		BeforeEach(func() {
+			vcapFile = filepath.Join(root, "vcap_services.json")
+			writeFile(vcapFile, `{"user-provided":[{"name":"newrelic","credentials":{"license_key":"`+licenseKey+`"}}]}`)
+			env[vcapServicesFilePathEnvVar] = vcapFile
+		})
+
+		It("reads VCAP_SERVICES_FILE_PATH when VCAP_SERVICES is not set", func() {
+			Expect(newRelicBinding(supplier)).To(Equal(`bound to user-provided-service "newrelic"`))
+
+			resolveAgentSettings(supplier)
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_LICENSE_KEY", licenseKey))
+		})
+
+		It("prefers VCAP_SERVICES", func() {
+			env["VCAP_SERVICES"] = `{}`
+			Expect(loadVcapServices(supplier)).To(BeNil())
+
+			env["VCAP_SERVICES"] = `{"newrelic":[{"name":"nr","credentials":{}}]}`
+			Expect(loadVcapServices(supplier)).To(HaveKey("newrelic"))
+		})
+
+		It("fails on a missing or invalid file", func() {
+			writeFile(vcapFile, "not json")
+			_, err := loadVcapServices(supplier)
+			Expect(err).To(MatchError(ContainSubstring("unable to parse VCAP_SERVICES_FILE_PATH file " + vcapFile)))
+
+			Expect(os.Remove(vcapFile)).To(Succeed())
+			_, err = loadVcapServices(supplier)
+			Expect(err).To(MatchError(ContainSubstring("unable to read VCAP_SERVICES_FILE_PATH file " + vcapFile)))
+			Expect(newRelicBinding(supplier)).To(BeEmpty())
+		})
+	})
+
+	Describe("Kubernetes service bindings", func() {
+		const bindingKey = "3333333333333333333333333333333333333333"
+		var bindingRoot string
+
+		writeBinding := func(name string, files map[string]string) {
+			for file, content := range files {
+				writeFile(filepath.Join(bindingRoot, name, file), content)
+			}
+		}
+
+		BeforeEach(func() {
+			bindingRoot = filepath.Join(root, "bindings")
+			env[serviceBindingRootEnvVar] = bindingRoot
+			writeBinding("nr", map[string]string{"type": "NewRelic\n", "provider": "newrelic.com", "license-key": bindingKey + "\n", "app_name": "binding-app"})
+			writeBinding("database", map[string]string{"type": "postgresql", "license_key": "ignored"})
+		})
+
+		It("reads the credentials of newrelic bindings", func() {
+			bindings := newRelicServiceBindings(supplier)
+
+			Expect(bindings).To(Equal([]serviceBinding{{
+				Name:        "nr",
+				Provider:    "newrelic.com",
+				Credentials: map[string]interface{}{"license_key": bindingKey, "app_name": "binding-app"},
+			}}))
+		})
+
+		It("takes precedence over the service broker, and user-provided services over it", func() {
+			env["VCAP_SERVICES"] = `{"newrelic": [{"name": "nr-broker", "credentials": {"licenseKey": "1111111111111111111111111111111111111111"}}]}`
+			resolveAgentSettings(supplier)
+			Expect(supplier.envVars).To(Equal(map[string]string{
+				"NEW_RELIC_APP_NAME":    "binding-app",
+				"NEW_RELIC_LICENSE_KEY": bindingKey,
+			}))
+			Expect(supplier.Redactor.Redact(bindingKey)).NotTo(ContainSubstring(bindingKey))
+
+			env["VCAP_SERVICES"] = `{"user-provided": [{"name": "newrelic", "credentials": {"app_name": "ups-app"}}]}`
+			resolveAgentSettings(supplier)
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_APP_NAME", "ups-app"))
+			Expect(supplier.envVars).To(HaveKeyWithValue("NEW_RELIC_LICENSE_KEY", bindingKey))
+		})
+
+		It("binds the app to New Relic", func() {
+			Expect(newRelicBinding(supplier)).To(Equal(`bound to service binding "nr" of type newrelic`))
+
+			Expect(os.RemoveAll(filepath.Join(bindingRoot, "nr"))).To(Succeed())
+			Expect(newRelicBinding(supplier)).To(BeEmpty())
+		})
+
+		It("ignores a missing binding root", func() {
+			env[serviceBindingRootEnvVar] = filepath.Join(root, "missing")
+
+			Expect(newRelicServiceBindings(supplier)).To(BeEmpty())
+			Expect(buffer.String()).NotTo(ContainSubstring("Unable to read service bindings"))
+		})
+	})
+
+	Describe("detectNewRelicService", func() {
+		It("detects New Relic env vars and services", func() {
+			Expect(detectNewRelicService(supplier)).To(BeFalse())
+
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"database","credentials":{}}]}`
+			Expect(detectNewRelicService(supplier)).To(BeFalse())
+
+			env["VCAP_SERVICES"] = `{"user-provided":[{"name":"MyNewRelic","credentials":{}}]}`
+			Expect(detectNewRelicService(supplier)).To(BeTrue())
+
+			env["VCAP_SERVICES"] = `{"newrelic":[{"name":"nr","credentials":{}}]}`
+			Expect(detectNewRelicService(supplier)).To(BeTrue())
+
+			delete(env, "VCAP_SERVICES")
+			env["NEW_RELIC_DOWNLOAD_URL"] = downloadURL
+			Expect(detectNewRelicService(supplier)).To(BeTrue())
+		})
+	})
+
+	Describe("getLatestAgentVersion", func() {
+		It("fails on a bad http status", func() {
+			httpClient.respond(bucketXMLUrl, http.StatusServiceUnavailable, "")
+
+			_, err := getLatestAgentVersion(supplier, nrVersionPattern)
+			Expect(err).To(MatchError(ContainSubstring("503 Service Unavailable")))
+		})
+	})
+})
@@ -0,0 +1,41 @@
+package nrbuildpack
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// env var pointing to a file with the VCAP_SERVICES json, set instead of VCAP_SERVICES
+// by Cloud Foundry releases that deliver large service bindings as a file
+const vcapServicesFilePathEnvVar = "VCAP_SERVICES_FILE_PATH"
+
+// loadVcapServices returns the services bound to the app from VCAP_SERVICES,
+// or from the file VCAP_SERVICES_FILE_PATH points to when VCAP_SERVICES is not set.
+// It returns nil without an error when the app has no bound services.
+func loadVcapServices(s *Supplier) (map[string]interface{}, error) {
+	source := "VCAP_SERVICES"
+	content := strings.TrimSpace(s.getenv("VCAP_SERVICES"))
+	if content == "" {
+		path := strings.TrimSpace(s.getenv(vcapServicesFilePathEnvVar))
+		if path == "" {
+			return nil, nil
+		}
+		source = vcapServicesFilePathEnvVar + " file " + path
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("unable to read " + source + ": " + err.Error())
+		}
+		content = strings.TrimSpace(string(data))
+	}
+	if in_array(content, []string{"", "{}"}) {
+		return nil, nil
+	}
+
+	var vcapServices map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &vcapServices); err != nil {
+		return nil, errors.New("unable to parse " + source + ": " + err.Error())
+	}
+	return vcapServices, nil
+}
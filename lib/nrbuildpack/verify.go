@@ -0,0 +1,203 @@
+package nrbuildpack
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+// record of the script enabling the profiler, written by supply in deps/IDX and read by finalize
+const profilerRecordFileName = "newrelic-profiler.yml"
+
+type profilerRecord struct {
+	Script string      `yaml:"script"` // path of the script during staging
+	Vars   []ScriptVar `yaml:"vars"`
+	Mode   string      `yaml:"mode,omitempty"` // see AppModeReporter
+}
+
+// DropletDirs are the staging folders verified by finalize
+type DropletDirs interface {
+	BuildDir() string
+	DepDir() string
+	DepsIdx() string
+	DepsDir() string
+}
+
+// Verification collects the problems found after all buildpacks supplied the app.
+// Errors fail the staging, warnings are only reported.
+type Verification struct {
+	Warnings []string
+	Errors   []string
+}
+
+func (v *Verification) Warn(message string) {
+	v.Warnings = append(v.Warnings, message)
+}
+
+func (v *Verification) Fail(message string) {
+	v.Errors = append(v.Errors, message)
+}
+
+// Report logs the warnings and errors, and returns an error if there are errors
+func (v *Verification) Report(log *libbuildpack.Logger) error {
+	for _, warning := range v.Warnings {
+		log.Warning("New Relic: %s", warning)
+	}
+	for _, err := range v.Errors {
+		log.Error("New Relic: %s", err)
+	}
+	if len(v.Errors) > 0 {
+		return errors.New("New Relic agent verification failed: " + strings.Join(v.Errors, "; "))
+	}
+	log.Info("New Relic agent verified")
+	return nil
+}
+
+func writeProfilerRecord(s *Supplier, scriptFile string, vars []ScriptVar) error {
+	record := profilerRecord{Script: scriptFile, Vars: vars}
+	if reporter, ok := s.Platform.(AppModeReporter); ok {
+		record.Mode = reporter.AppMode(s)
+	}
+	return libbuildpack.NewYAML().Write(filepath.Join(s.Stager.DepDir(), profilerRecordFileName), record)
+}
+
+// StagedAppMode returns the app mode recorded by supply, "" if there is none
+func StagedAppMode(dirs DropletDirs) string {
+	var record profilerRecord
+	if err := libbuildpack.NewYAML().Load(filepath.Join(dirs.DepDir(), profilerRecordFileName), &record); err != nil {
+		return ""
+	}
+	return record.Mode
+}
+
+// VerifyProfiler checks that the script written by supply is still there, that the profiler paths
+// it sets resolve inside the droplet, and that no script running after it sets the same env vars.
+// It returns false if supply didn't install the agent.
+func VerifyProfiler(dirs DropletDirs, v *Verification) bool {
+	recordFile := filepath.Join(dirs.DepDir(), profilerRecordFileName)
+	if exists, err := libbuildpack.FileExists(recordFile); err != nil || !exists {
+		return false
+	}
+	var record profilerRecord
+	if err := libbuildpack.NewYAML().Load(recordFile, &record); err != nil {
+		v.Fail("unable to read " + recordFile + ": " + err.Error())
+		return true
+	}
+
+	if exists, err := libbuildpack.FileExists(record.Script); err != nil || !exists {
+		v.Fail("the script enabling the profiler " + record.Script + " was removed by another buildpack")
+		return true
+	}
+
+	for _, scriptVar := range record.Vars {
+		if !scriptVar.IsPath {
+			continue
+		}
+		path, ok := resolveScriptPath(dirs, record.Script, scriptVar)
+		if !ok {
+			v.Warn("unable to verify " + scriptVar.Name + ", it is relative to " + scriptVar.Ref)
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			v.Fail(scriptVar.Name + " points to " + path + ", which does not exist in the droplet")
+		}
+	}
+
+	if filepath.Base(filepath.Dir(record.Script)) == "profile.d" {
+		verifyNotOverwritten(dirs, record, v)
+	}
+	return true
+}
+
+// verifyScriptPaths checks the paths of the script when supply wrote it. Finalize only runs when the
+// extension is the final buildpack, which it usually isn't, so it can't be the only check.
+func verifyScriptPaths(s *Supplier) error {
+	v := &Verification{}
+	VerifyProfiler(s.Stager, v)
+	for _, warning := range v.Warnings {
+		s.warn("New Relic: %s", warning)
+	}
+	if len(v.Errors) > 0 {
+		for _, err := range v.Errors {
+			s.Log.Error("New Relic: %s", err)
+		}
+		return errors.New("New Relic agent verification failed: " + strings.Join(v.Errors, "; "))
+	}
+	return nil
+}
+
+// resolveScriptPath returns the staging path of a path set by the script
+func resolveScriptPath(dirs DropletDirs, scriptFile string, scriptVar ScriptVar) (string, bool) {
+	path := filepath.FromSlash(strings.Replace(scriptVar.Value, "\\", "/", -1))
+	switch scriptVar.Ref {
+	case "":
+		return path, true
+	case "DEPS_DIR":
+		return filepath.Join(dirs.DepsDir(), path), true
+	case "HOME":
+		return filepath.Join(dirs.BuildDir(), path), true
+	case "~dp0":
+		// folder of the batch script when it runs: the final buildpack copies the profile.d scripts
+		// of supply buildpacks to .profile.d of the app, scripts elsewhere run where they are
+		scriptDir := filepath.Dir(scriptFile)
+		if filepath.Base(scriptDir) == "profile.d" {
+			scriptDir = filepath.Join(dirs.BuildDir(), ".profile.d")
+		}
+		return filepath.Join(scriptDir, path), true
+	}
+	return "", false
+}
+
+// verifyNotOverwritten warns about the profile.d scripts of later buildpacks and of the app
+// which set the env vars of the New Relic script, since they run after it
+func verifyNotOverwritten(dirs DropletDirs, record profilerRecord, v *Verification) {
+	ourIdx, err := strconv.Atoi(dirs.DepsIdx())
+	if err != nil {
+		return
+	}
+
+	// profile.d scripts run in the order of the buildpacks, then the ones of the app and .profile
+	var laterIdxs []int
+	depDirs, _ := ioutil.ReadDir(dirs.DepsDir())
+	for _, depDir := range depDirs {
+		if idx, err := strconv.Atoi(depDir.Name()); err == nil && idx > ourIdx {
+			laterIdxs = append(laterIdxs, idx)
+		}
+	}
+	sort.Ints(laterIdxs)
+
+	var laterScripts []string
+	for _, idx := range laterIdxs {
+		scripts, _ := filepath.Glob(filepath.Join(dirs.DepsDir(), strconv.Itoa(idx), "profile.d", "*"))
+		laterScripts = append(laterScripts, scripts...)
+	}
+	appScripts, _ := filepath.Glob(filepath.Join(dirs.BuildDir(), ".profile.d", "*"))
+	laterScripts = append(laterScripts, appScripts...)
+	laterScripts = append(laterScripts, filepath.Join(dirs.BuildDir(), ".profile"))
+
+	for _, script := range laterScripts {
+		content, err := ioutil.ReadFile(script)
+		if err != nil {
+			continue
+		}
+		for _, scriptVar := range record.Vars {
+			if setsEnvVar(string(content), scriptVar.Name) {
+				v.Warn(scriptVar.Name + " is also set by " + script + ", which runs after the New Relic script and overrides it")
+			}
+		}
+	}
+}
+
+// setsEnvVar reports if a shell or batch script sets or unsets the env var
+func setsEnvVar(content string, name string) bool {
+	quoted := regexp.QuoteMeta(name)
+	pattern := regexp.MustCompile(`(?mi)^\s*((export\s+|set\s+"?)?` + quoted + `=|unset\s+` + quoted + `\b)`)
+	return pattern.MatchString(content)
+}
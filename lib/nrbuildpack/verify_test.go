@@ -0,0 +1,145 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudfoundry/libbuildpack"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("VerifyProfiler", func() {
+	var (
+		root     string
+		stager   *fakeStager
+		supplier *Supplier
+		v        *Verification
+	)
+
+	writeFile := func(name string, content string) {
+		Expect(os.MkdirAll(filepath.Dir(name), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(name, []byte(content), 0644)).To(Succeed())
+	}
+
+	// supply installed the agent in deps/0/agent and enabled it from deps/0/profile.d/newrelic.sh
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "nrbuildpack-verify")
+		Expect(err).NotTo(HaveOccurred())
+
+		stager = newFakeStager(root)
+		redactor := NewRedactor(new(bytes.Buffer))
+		supplier = &Supplier{Stager: stager, Log: libbuildpack.NewLogger(redactor), Redactor: redactor}
+		v = &Verification{}
+
+		writeFile(filepath.Join(stager.DepDir(), "agent", "libNewRelicProfiler.so"), "profiler")
+		script := NewScript(PosixShell)
+		script.SetEnvPath("CORECLR_PROFILER_PATH", "DEPS_DIR", "/0/agent/libNewRelicProfiler.so")
+		script.SetEnv("CORECLR_ENABLE_PROFILING", "1")
+		content, err := script.Render()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stager.WriteProfileD("newrelic.sh", content)).To(Succeed())
+		Expect(writeProfilerRecord(supplier, filepath.Join(stager.DepDir(), "profile.d", "newrelic.sh"), script.Vars())).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+	})
+
+	It("accepts an intact installation", func() {
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(BeEmpty())
+		Expect(v.Warnings).To(BeEmpty())
+	})
+
+	It("records the app mode of the platform for finalize", func() {
+		Expect(StagedAppMode(stager)).To(Equal(""))
+
+		supplier.Platform = &fakeModePlatform{mode: "worker"}
+		Expect(writeProfilerRecord(supplier, filepath.Join(stager.DepDir(), "profile.d", "newrelic.sh"), nil)).To(Succeed())
+		Expect(StagedAppMode(stager)).To(Equal("worker"))
+	})
+
+	It("returns false when supply didn't install the agent", func() {
+		Expect(os.Remove(filepath.Join(stager.DepDir(), profilerRecordFileName))).To(Succeed())
+
+		Expect(VerifyProfiler(stager, v)).To(BeFalse())
+		Expect(v.Errors).To(BeEmpty())
+	})
+
+	It("fails when a profiler path doesn't resolve", func() {
+		Expect(os.RemoveAll(filepath.Join(stager.DepDir(), "agent"))).To(Succeed())
+
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(ConsistOf(ContainSubstring("CORECLR_PROFILER_PATH points to")))
+	})
+
+	It("fails when the script was removed", func() {
+		Expect(os.Remove(filepath.Join(stager.DepDir(), "profile.d", "newrelic.sh"))).To(Succeed())
+
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(ConsistOf(ContainSubstring("was removed by another buildpack")))
+	})
+
+	It("warns about later scripts setting the profiler env vars", func() {
+		writeFile(filepath.Join(stager.DepsDir(), "1", "profile.d", "other.sh"), "export CORECLR_ENABLE_PROFILING=0\n")
+		writeFile(filepath.Join(stager.BuildDir(), ".profile"), "unset CORECLR_PROFILER_PATH\n")
+		writeFile(filepath.Join(stager.BuildDir(), ".profile.d", "app.sh"), "export NOT_CORECLR_PROFILER_PATH=1\nexport OTHER=1\n")
+
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(BeEmpty())
+		Expect(v.Warnings).To(ConsistOf(
+			ContainSubstring("CORECLR_ENABLE_PROFILING is also set by "+filepath.Join(stager.DepsDir(), "1", "profile.d", "other.sh")),
+			ContainSubstring("CORECLR_PROFILER_PATH is also set by "+filepath.Join(stager.BuildDir(), ".profile")),
+		))
+	})
+
+	It("resolves batch paths relative to the script", func() {
+		writeFile(filepath.Join(stager.BuildDir(), "newrelic", "NewRelic.Profiler.dll"), "profiler")
+		script := NewScript(WindowsBatch)
+		script.SetEnvPath("COR_PROFILER_PATH", "~dp0", "newrelic\\NewRelic.Profiler.dll")
+		script.SetEnvPath("NEWRELIC_HOME", "~dp0", "newrelic\\missing")
+		runCmd := filepath.Join(stager.BuildDir(), "run.cmd")
+		writeFile(runCmd, "")
+		Expect(writeProfilerRecord(supplier, runCmd, script.Vars())).To(Succeed())
+
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(ConsistOf(ContainSubstring("NEWRELIC_HOME points to " + filepath.Join(stager.BuildDir(), "newrelic", "missing"))))
+	})
+
+	It("resolves batch paths of profile.d scripts from .profile.d of the app, where they run", func() {
+		writeFile(filepath.Join(stager.DepDir(), "newrelic", "NewRelic.Profiler.dll"), "profiler")
+		script := NewScript(WindowsBatch)
+		script.SetEnvPath("COR_PROFILER_PATH", "~dp0", "..\\newrelic\\NewRelic.Profiler.dll")
+		profileD := filepath.Join(stager.DepDir(), "profile.d", "newrelic.bat")
+		writeFile(profileD, "")
+		Expect(writeProfilerRecord(supplier, profileD, script.Vars())).To(Succeed())
+
+		Expect(VerifyProfiler(stager, v)).To(BeTrue())
+		Expect(v.Errors).To(ConsistOf(ContainSubstring("COR_PROFILER_PATH points to " + filepath.Join(stager.BuildDir(), "newrelic", "NewRelic.Profiler.dll"))))
+	})
+
+	It("checks the paths of the script in supply", func() {
+		Expect(verifyScriptPaths(supplier)).To(Succeed())
+
+		Expect(os.RemoveAll(filepath.Join(stager.DepDir(), "agent"))).To(Succeed())
+		Expect(verifyScriptPaths(supplier)).To(MatchError(ContainSubstring("CORECLR_PROFILER_PATH points to " + filepath.Join(stager.DepDir(), "agent", "libNewRelicProfiler.so"))))
+	})
+
+	Describe("Report", func() {
+		It("logs warnings and returns an error for errors", func() {
+			buffer := new(bytes.Buffer)
+			logger := libbuildpack.NewLogger(buffer)
+			v.Warn("a warning")
+			Expect(v.Report(logger)).To(Succeed())
+			Expect(buffer.String()).To(ContainSubstring("New Relic: a warning"))
+
+			v.Fail("an error")
+			Expect(v.Report(logger)).To(MatchError("New Relic agent verification failed: an error"))
+			Expect(buffer.String()).To(ContainSubstring("New Relic: an error"))
+		})
+	})
+})
@@ -0,0 +1,365 @@
+package nrbuildpack
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// xmlNode is a minimal editable view of an xml document (i.e. newrelic.config).
+// Every node keeps the markup it was parsed from, so only the elements that are
+// changed get re-rendered and the rest of the file keeps its original formatting.
+type xmlNode struct {
+	raw      string // original markup (start tag for elements)
+	name     string // element name including prefix, empty for non-element nodes
+	attrs    []xml.Attr
+	indent   string // whitespace preceding the element on its line
+	endRaw   string // original end tag, empty for self-closing elements
+	modified bool   // start tag must be rendered from name and attrs
+	children []*xmlNode
+}
+
+func loadXMLFile(path string) (*xmlNode, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseXML(data)
+}
+
+func parseXML(data []byte) (*xmlNode, error) {
+	doc := &xmlNode{}
+	stack := []*xmlNode{doc}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	offset := decoder.InputOffset()
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw := string(data[offset:decoder.InputOffset()])
+		offset = decoder.InputOffset()
+
+		parent := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := &xmlNode{raw: raw, name: qualifiedName(t.Name), attrs: t.Copy().Attr, indent: trailingIndent(parent)}
+			parent.children = append(parent.children, element)
+			stack = append(stack, element)
+		case xml.EndElement:
+			if len(stack) < 2 {
+				return nil, errors.New("unexpected end element " + qualifiedName(t.Name))
+			}
+			parent.endRaw = raw // empty for self-closing elements
+			stack = stack[:len(stack)-1]
+		default:
+			parent.children = append(parent.children, &xmlNode{raw: raw})
+		}
+	}
+	if len(stack) != 1 {
+		return nil, errors.New("unexpected end of xml document")
+	}
+	return doc, nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func localName(name string) string {
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+// trailingIndent returns the whitespace after the last line break of the parent's last text node
+func trailingIndent(parent *xmlNode) string {
+	if len(parent.children) == 0 {
+		return ""
+	}
+	last := parent.children[len(parent.children)-1]
+	if last.name != "" || strings.TrimSpace(last.raw) != "" {
+		return ""
+	}
+	return last.raw[strings.LastIndex(last.raw, "\n")+1:]
+}
+
+func (n *xmlNode) writeTo(buffer *bytes.Buffer) {
+	if n.name == "" {
+		buffer.WriteString(n.raw)
+	} else if n.modified {
+		buffer.WriteString("<" + n.name)
+		for _, attr := range n.attrs {
+			buffer.WriteString(" " + qualifiedName(attr.Name) + "=\"" + escapeXML(attr.Value) + "\"")
+		}
+		if n.endRaw == "" {
+			buffer.WriteString(" />")
+		} else {
+			buffer.WriteString(">")
+		}
+	} else {
+		buffer.WriteString(n.raw)
+	}
+	for _, child := range n.children {
+		child.writeTo(buffer)
+	}
+	buffer.WriteString(n.endRaw)
+}
+
+func (n *xmlNode) bytes() []byte {
+	var buffer bytes.Buffer
+	n.writeTo(&buffer)
+	return buffer.Bytes()
+}
+
+func (n *xmlNode) save(path string) error {
+	return writeToFile(bytes.NewReader(n.bytes()), path, 0644)
+}
+
+// root returns the document element
+func (n *xmlNode) root() *xmlNode {
+	for _, child := range n.children {
+		if child.name != "" {
+			return child
+		}
+	}
+	return nil
+}
+
+// elements returns the child elements with the given local name
+func (n *xmlNode) elements(name string) []*xmlNode {
+	var found []*xmlNode
+	for _, child := range n.children {
+		if child.name != "" && localName(child.name) == name {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, attr := range n.attrs {
+		if localName(qualifiedName(attr.Name)) == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	n.modified = true
+	for i, attr := range n.attrs {
+		if localName(qualifiedName(attr.Name)) == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *xmlNode) text() string {
+	var text bytes.Buffer
+	for _, child := range n.children {
+		if child.name == "" {
+			text.WriteString(child.raw)
+		}
+	}
+	return unescapeXML(text.String())
+}
+
+func (n *xmlNode) setText(value string) {
+	n.children = []*xmlNode{{raw: escapeXML(value)}}
+	if n.endRaw == "" {
+		n.modified = true
+		n.endRaw = "</" + n.name + ">"
+	}
+}
+
+// appendElement adds a new child element, indented one level deeper than n
+func (n *xmlNode) appendElement(name string) *xmlNode {
+	prefix := ""
+	if i := strings.LastIndex(n.name, ":"); i >= 0 {
+		prefix = n.name[:i+1]
+	}
+	childIndent := n.indent + "    "
+	for _, child := range n.children {
+		if child.name != "" {
+			childIndent = child.indent
+			break
+		}
+	}
+	// keep the line breaks of the file, i.e. \r\n of a Web.config edited on windows
+	newline := "\n"
+	for _, child := range n.children {
+		if child.name == "" && strings.Contains(child.raw, "\r\n") {
+			newline = "\r\n"
+			break
+		}
+	}
+	element := &xmlNode{name: prefix + name, indent: childIndent, modified: true}
+
+	if n.endRaw == "" {
+		n.modified = true
+		n.endRaw = "</" + n.name + ">"
+	}
+	// keep the whitespace before the closing tag as the last child
+	var closingWhitespace *xmlNode
+	if last := len(n.children) - 1; last >= 0 && n.children[last].name == "" && strings.TrimSpace(n.children[last].raw) == "" {
+		closingWhitespace = n.children[last]
+		n.children = n.children[:last]
+	} else {
+		closingWhitespace = &xmlNode{raw: newline + n.indent}
+	}
+	n.children = append(n.children, &xmlNode{raw: newline + childIndent}, element, closingWhitespace)
+	return element
+}
+
+// setValue sets the value at an xml path relative to the document element.
+// The path separates elements with "/" and may end with "@attribute", e.g. "service/proxy@host".
+// Missing elements are created.
+func (n *xmlNode) setValue(path string, value string) error {
+	element := n.root()
+	if element == nil {
+		return errors.New("xml document has no root element")
+	}
+	elementPath, attribute := path, ""
+	if i := strings.Index(path, "@"); i >= 0 {
+		elementPath, attribute = path[:i], path[i+1:]
+	}
+	for _, name := range strings.Split(strings.Trim(elementPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if found := element.elements(name); len(found) > 0 {
+			element = found[0]
+		} else {
+			element = element.appendElement(name)
+		}
+	}
+	if attribute != "" {
+		element.setAttr(attribute, value)
+	} else {
+		element.setText(value)
+	}
+	return nil
+}
+
+// AddInstrumentedApplications lists executables in instrumentation/applications of newrelic.config,
+// the .Net Framework agent only instruments processes other than IIS and hwc.exe when they are listed.
+// It returns the executables which were not listed yet.
+func AddInstrumentedApplications(newrelicConfigFile string, executables []string) ([]string, error) {
+	newrelicConfig, err := loadXMLFile(newrelicConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	configuration := newrelicConfig.root()
+	if configuration == nil {
+		return nil, errors.New("xml document has no root element")
+	}
+	instrumentation := childElement(configuration, "instrumentation")
+	applications := childElement(instrumentation, "applications")
+
+	var added []string
+	for _, executable := range executables {
+		listed := false
+		for _, application := range applications.elements("application") {
+			if name, _ := application.attr("name"); strings.EqualFold(name, executable) {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			applications.appendElement("application").setAttr("name", executable)
+			added = append(added, executable)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	return added, newrelicConfig.save(newrelicConfigFile)
+}
+
+// SetAppSettings adds the settings to the <appSettings> of a Web.config or app.config file as
+// <add key="..." value="..." />. Keys which are already there keep their value unless override is set.
+// It returns the keys which were set and the ones which were kept, the rest of the file is left as it is.
+func SetAppSettings(configFile string, settings map[string]string, override bool) ([]string, []string, error) {
+	config, err := loadXMLFile(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	configuration := config.root()
+	if configuration == nil {
+		return nil, nil, errors.New("xml document has no root element")
+	}
+	appSettings := childElement(configuration, "appSettings")
+	if source, ok := appSettings.attr("configSource"); ok {
+		return nil, nil, errors.New("appSettings are in " + source)
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var set, kept []string
+	for _, key := range keys {
+		var existing *xmlNode
+		for _, add := range appSettings.elements("add") {
+			// appSettings keys are case insensitive
+			if name, _ := add.attr("key"); strings.EqualFold(name, key) {
+				existing = add
+			}
+		}
+		switch {
+		case existing == nil:
+			add := appSettings.appendElement("add")
+			add.setAttr("key", key)
+			add.setAttr("value", settings[key])
+			set = append(set, key)
+		case !override:
+			kept = append(kept, key)
+		default:
+			if value, _ := existing.attr("value"); value != settings[key] {
+				existing.setAttr("value", settings[key])
+			}
+			set = append(set, key)
+		}
+	}
+	if len(set) == 0 {
+		return nil, kept, nil
+	}
+	return set, kept, config.save(configFile)
+}
+
+// childElement returns the first child element with the local name, after creating it if there is none
+func childElement(n *xmlNode, name string) *xmlNode {
+	if found := n.elements(name); len(found) > 0 {
+		return found[0]
+	}
+	return n.appendElement(name)
+}
+
+func escapeXML(value string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
+
+func unescapeXML(value string) string {
+	var text string
+	if err := xml.Unmarshal([]byte("<v>"+value+"</v>"), &text); err != nil {
+		return value
+	}
+	return text
+}
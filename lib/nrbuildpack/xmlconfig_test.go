@@ -0,0 +1,43 @@
+package nrbuildpack
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("xmlNode", func() {
+	edit := func(document string, path string, value string) string {
+		doc, err := parseXML([]byte(document))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doc.setValue(path, value)).To(Succeed())
+		return string(doc.bytes())
+	}
+
+	It("sets existing attributes and text without touching the rest of the file", func() {
+		document := "<?xml version=\"1.0\"?>\n<!-- agent -->\n<configuration xmlns=\"urn:newrelic-config\">\n  <service licenseKey='old' ssl=\"true\"/>\n  <log level=\"info\">old</log>\n</configuration>\n"
+
+		Expect(edit(document, "service@licenseKey", "new")).To(Equal("<?xml version=\"1.0\"?>\n<!-- agent -->\n<configuration xmlns=\"urn:newrelic-config\">\n  <service licenseKey=\"new\" ssl=\"true\" />\n  <log level=\"info\">old</log>\n</configuration>\n"))
+		Expect(edit(document, "log", "a < b")).To(Equal("<?xml version=\"1.0\"?>\n<!-- agent -->\n<configuration xmlns=\"urn:newrelic-config\">\n  <service licenseKey='old' ssl=\"true\"/>\n  <log level=\"info\">a &lt; b</log>\n</configuration>\n"))
+	})
+
+	It("adds missing attributes", func() {
+		Expect(edit("<configuration>\n  <service />\n</configuration>", "service@host", "proxy")).
+			To(Equal("<configuration>\n  <service host=\"proxy\" />\n</configuration>"))
+	})
+
+	It("creates missing elements indented like their siblings", func() {
+		Expect(edit("<configuration>\n  <log />\n</configuration>", "service/proxy@host", "proxy.example.com")).
+			To(Equal("<configuration>\n  <log />\n  <service>\n      <proxy host=\"proxy.example.com\" />\n  </service>\n</configuration>"))
+	})
+
+	It("opens self-closing elements to add children", func() {
+		Expect(edit("<configuration/>", "appSettings", "value")).
+			To(Equal("<configuration>\n    <appSettings>value</appSettings>\n</configuration>"))
+	})
+
+	It("fails without a document element", func() {
+		doc, err := parseXML([]byte("<!-- empty -->"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doc.setValue("service@host", "proxy")).To(MatchError("xml document has no root element"))
+	})
+})